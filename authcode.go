@@ -1,10 +1,20 @@
 package oauth2cli
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"html/template"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/browser"
@@ -18,8 +28,308 @@ type AuthCodeFlow struct {
 	AuthCodeOptions []oauth2.AuthCodeOption // Options passed to AuthCodeURL().
 	LocalServerPort int                     // Local server port. Default to a random port.
 	SkipOpenBrowser bool                    // Skip opening browser if it is true.
+	StartupDelay    time.Duration           // Delay before opening the browser after the local server is ready. Default to no delay.
+	Timeout         time.Duration           // Timeout of the whole flow, including the discovery, authorization and token request. Default to no timeout.
 
-	ShowLocalServerURL func(url string) // Called when the local server is started. Default to show a message via the logger.
+	// Issuer URL of the provider, e.g. https://accounts.google.com.
+	// If this is set and Config.Endpoint is empty, the endpoint is resolved by the discovery document of the issuer.
+	// See Discover for details.
+	Issuer string
+
+	// Whether to open the browser. SkipOpenBrowser takes precedence over this.
+	// Default to BrowserAuto, i.e. the URL is only shown in a headless environment such as an SSH session.
+	Browser BrowserMode
+	// Timeout of opening the browser. If it exceeds, the flow continues and the user can open the URL manually.
+	// Default to 10 seconds.
+	OpenBrowserTimeout time.Duration
+
+	// Open the authorization URL of the provider in the browser, instead of the local server which redirects to it.
+	// This avoids the extra hop via localhost, e.g. for a provider with a strict referrer policy.
+	// ShowLocalServerURL is called with the authorization URL as well.
+	// NoCallbackActivityTimeout is ignored, because the local server receives no request until the callback.
+	OpenAuthURLDirectly bool
+
+	// Hostname of the local server URL, which is used as the redirect URL if Config.RedirectURL is empty.
+	// Set this if the provider requires a registered hostname, e.g. 127.0.0.1 or a domain resolved to the loopback address.
+	// If this is a loopback IP literal, e.g. 127.0.0.1 or ::1, the local server listens on the address,
+	// because localhost may be resolved to the other address family by the browser.
+	// Otherwise the local server listens on localhost.
+	// Default to localhost.
+	RedirectURLHostname string
+
+	// Address of the interface which the local server listens on, e.g. 0.0.0.0 to receive the callback
+	// from a browser outside of a container. This exposes the local server to the network.
+	// Default to the loopback interface, i.e. localhost or the loopback IP literal of RedirectURLHostname,
+	// so that the local server is not reachable from the network as RFC 8252 section 8.3.
+	LocalServerBindAddress string
+
+	// Candidates of the local server port, tried in order. A port in use is skipped.
+	// This takes precedence over LocalServerPort.
+	// If all ports are in use, the flow returns an error which wraps ErrPortInUse.
+	// Use PortRange for a range of ports, e.g. PortRange(8000, 8010).
+	LocalServerPorts []int
+
+	// Listener of the local server. Default to listen on LocalServerPort of localhost.
+	// If this is not a TCP listener, e.g. a Unix domain socket, Config.RedirectURL is required.
+	// The listener is closed when the flow is finished, so set a new one for each call.
+	Listener net.Listener
+
+	ShowLocalServerURL func(url string) // Called when the local server is started. Default to show a message via the Logger.
+	OnCodeReceived     func()           // Called when a valid authorization code is received, before the token request.
+
+	// Called with the URL of the authorization request before showing the local server URL and opening the browser.
+	// If this returns an error, the flow is aborted without any request to the provider.
+	// This is useful to show the client ID and scopes to the user and ask for confirmation.
+	BeforeOpenBrowser func(authURL string) error
+
+	// Called on each stage of the flow in order, in another goroutine.
+	// EventBrowserOpened and EventWaiting are skipped if the authorization response arrived before opening the browser.
+	EventHandler func(Event)
+
+	Logger  Logger  // Logger to write messages of the flow. Default to DefaultLogger.
+	Metrics Metrics // Metrics to observe durations of the flow. Default to none.
+
+	// Write a summary of the token response via the Logger, same as ClientSettings.LogTokenResponse.
+	LogTokenResponse bool
+
+	// Abort if no request reached the local server within the duration after opening the browser.
+	// This is ignored if OpenAuthURLDirectly is set. Default to wait forever.
+	NoCallbackActivityTimeout time.Duration
+
+	// Serve the local server over HTTPS if it is true.
+	// By default a self-signed certificate for localhost is generated on the fly,
+	// so the user may need to accept the certificate in the browser once.
+	UseTLS  bool
+	TLSCert []byte // PEM encoded certificate of the local server. Default to a generated self-signed certificate.
+	TLSKey  []byte // PEM encoded private key of the local server. Required if TLSCert is set.
+
+	// Paths to the PEM encoded certificate and private key of the local server, e.g. generated by mkcert.
+	// If LocalServerCertFile is set, the local server is served over HTTPS regardless of UseTLS.
+	// TLSCert takes precedence over this.
+	LocalServerCertFile string
+	LocalServerKeyFile  string
+
+	// Force the user to log in again even if the provider has a session, by sending prompt=login.
+	// Most OpenID Connect providers and Microsoft identity platform (Azure AD) honor it.
+	// Some providers do not support prompt=login, e.g. Google accepts only none, consent or select_account.
+	// In that case, set a provider specific parameter via AuthCodeOptions instead.
+	ForceLogin bool
+
+	Prompt    string // prompt parameter of the authorization request, e.g. consent or select_account. Omitted if empty.
+	LoginHint string // login_hint parameter of the authorization request, e.g. an email address. Omitted if empty.
+	Audience  string // audience parameter of the authorization request and token request, e.g. an API of Auth0. Omitted if empty.
+
+	// response_type parameter of the authorization request. Default to code.
+	// For a hybrid flow of OpenID Connect, e.g. "code id_token", response_mode=form_post is sent as well
+	// so that the local server receives the ID token, unless it is set via AuthCodeOptions.
+	// The ID token in the authorization response is available via Result.IDToken,
+	// if the token response does not contain one.
+	ResponseType string
+
+	// Return ErrMissingIDToken if neither of the token response nor the authorization response has an ID token.
+	// An empty id_token is treated as absent, and it is omitted from Token.Extra() regardless of this.
+	RequireIDToken bool
+
+	// Verify the ID token of the result by the JWKS of the provider.
+	// If this is set, the ID token is required, and Result.IDTokenClaims has the verified claims.
+	// Default to no verification, i.e. the claims are decoded without verification.
+	IDTokenVerifier *IDTokenVerifier
+
+	// resource parameters of the authorization request and token request, as defined in RFC 8707.
+	// Each value is sent as a separate parameter, e.g. resource=https://a.example.com&resource=https://b.example.com.
+	// See https://tools.ietf.org/html/rfc8707
+	Resources []string
+
+	// HTTP client used for requests to the provider, such as the token request.
+	// Default to the same client as ClientSettings.HTTPClient.
+	HTTPClient *http.Client
+
+	TokenRequestTimeout time.Duration // Timeout of the token request. Default to 30 seconds.
+
+	// Parameters of the token request for a non-standard provider.
+	// TokenRequestParams are added to the form, e.g. tenant,
+	// but they cannot override grant_type, code and redirect_uri.
+	GrantType          string     // grant_type parameter of the token request. Default to authorization_code.
+	TokenRequestParams url.Values // Additional parameters of the token request.
+
+	// Escape hatch to encode the body of the token request for a non-conformant provider,
+	// e.g. to send the parameters in a specific order or the code without escaping.
+	// Default to the standard form encoding, which sorts the parameters by key.
+	TokenRequestEncoder TokenRequestEncoder
+
+	// Authenticate the client by a JWT signed with the private key, i.e. private_key_jwt.
+	// If this is set, Config.ClientSecret is not sent.
+	// Default to the client secret in the style of AuthStyle.
+	ClientAssertion *ClientAssertion
+
+	// How the client credentials are sent in the token request. This is ignored if ClientAssertion is set.
+	// Set AuthStyleCache to share the style detected by AuthStyleAutoDetect between flows.
+	// Default to AuthStyleAutoDetect.
+	AuthStyle      AuthStyle
+	AuthStyleCache *AuthStyleCache
+
+	// Retry the token request on a transient error, i.e. 429 or 5xx, up to the attempts.
+	// The interval starts from TokenRequestRetryBackoff and doubles on each retry.
+	// Retry-After header of the response is honored if present, up to 1 minute. A longer one is returned as the error.
+	// An OAuth error such as invalid_grant is never retried.
+	TokenRequestMaxAttempts  int           // Default to 1, i.e. no retry.
+	TokenRequestRetryBackoff time.Duration // Default to 1 second.
+
+	// State parameter of the authorization request. Default to a random string.
+	// If this is set, it is used as-is and the authorization response must have the same value.
+	State string
+
+	StateGenerator func() (string, error) // Called to generate a state parameter if State is empty. It must return a non-empty string. Default to a random string.
+
+	// Called with the state parameter before the authorization request is made,
+	// e.g. to persist it so that another process can verify the authorization response and call Exchange.
+	// If this returns an error, the flow is aborted.
+	SaveState func(state string) error
+
+	// Nonce parameter of the authorization request, which is verified against nonce claim of the ID token.
+	// Default to a random string if the openid scope is requested, otherwise none.
+	// See https://openid.net/specs/openid-connect-core-1_0.html#NonceNotes
+	Nonce string
+
+	ShutdownTimeout time.Duration // Timeout to wait for the local server to finish the response on shutdown. Default to 2 seconds.
+
+	// Timeouts of a connection to the local server, so that a misbehaving client cannot hold the server.
+	LocalServerReadHeaderTimeout time.Duration // Default to 10 seconds.
+	LocalServerReadTimeout       time.Duration // Default to 30 seconds.
+	LocalServerWriteTimeout      time.Duration // Default to 30 seconds. A response waiting for the token exchange is not limited.
+	LocalServerIdleTimeout       time.Duration // Timeout of a keep-alive connection. Default to 30 seconds.
+
+	// Skip closing the browser tab by script after the authorization, if it is true.
+	// The success page always shows a message to return to the terminal,
+	// because some browsers do not allow a script to close a tab which is not opened by a script.
+	SkipAutoClose bool
+
+	// Response to the browser after the authorization, e.g. JSON for a client driving the callback programmatically.
+	// Default to the HTML page, which closes the tab unless SkipAutoClose.
+	SuccessResponse *SuccessResponse
+
+	// HTML of the error page, e.g. branded or localized content.
+	// This is shown if the authorization response is an error, invalid or already used, or the flow is cancelled.
+	// The details of the error are returned by GetToken, and not shown in the page.
+	// Default to the plain text of the error.
+	LocalServerErrorHTML string
+
+	// Keep the local server until the token exchange is completed, and serve the result at status relative to the callback path,
+	// e.g. /status for the callback path /, or /oauth/status for /oauth/callback.
+	// The success page waits for it and shows the result, so that it does not say complete before the token exchange.
+	// The status endpoint responds {"status":"ok"} or {"status":"error"} in JSON when the token exchange is completed.
+	// The local server is shut down after the status is fetched, or ShutdownTimeout elapses.
+	// This is ignored if SuccessResponse is set, because the page does not fetch the status.
+	WaitForTokenExchange bool
+
+	// Template of the success page, executed with SuccessTemplateData after the token exchange is completed.
+	// The local server responds to the authorization response after the token exchange, and SuccessResponse is ignored.
+	// If the execution fails, the error is written via the Logger, and the default success page is shown,
+	// or the error page if the token exchange failed.
+	// Default to the static success page.
+	SuccessTemplate *template.Template
+
+	// Wrap the handler of the local server, e.g. to log requests or reject unexpected ones.
+	// The middleware must pass the authorization response to the handler to complete the flow.
+	Middleware func(http.Handler) http.Handler
+
+	// Called for every request to the local server, e.g. to detect another client probing the port during the flow.
+	// The request is accepted if the status code of the response is less than 400.
+	// The path does not contain the query, which may contain the authorization code.
+	AuditLog func(method, path, remoteAddr string, accepted bool)
+
+	// Return an error if Config.RedirectURL does not point to the local server, i.e. the scheme, port or loopback host differs.
+	// By default a warning is written via the Logger, because the authorization response would never reach the local server.
+	// This is not checked if the Listener is not a TCP listener.
+	StrictRedirectCheck bool
+
+	// Path of the callback on the local server, e.g. /oauth/callback for a registered redirect URI with the exact path.
+	// If Config.RedirectURL is empty, the redirect URL is the local server with this path, e.g. http://localhost:8000/oauth/callback.
+	//
+	// This is also used if the browser reaches the local server via a reverse proxy.
+	// For example, if a proxy forwards https://proxy.example.com/oauth/callback to http://localhost:8000/callback,
+	// set Config.RedirectURL to the former and this to /callback.
+	// The redirect URL is not checked against the local server if this is set.
+	// X-Forwarded-* headers are not used by the local server.
+	// It must start with /. Default to the path of Config.RedirectURL.
+	LocalServerCallbackPath string
+
+	// Names of the parameters of the authorization response, for a non-conformant provider.
+	// Default to the standard names.
+	ResponseParamNames ResponseParamNames
+
+	// Handler of the local server for a request other than the authorization response, e.g. a health check.
+	// The callback path, / and /favicon.ico take precedence over this.
+	// Default to respond 404.
+	FallbackHandler http.Handler
+}
+
+const (
+	defaultTokenRequestTimeout      = 30 * time.Second
+	defaultTokenRequestRetryBackoff = 1 * time.Second
+	defaultShutdownTimeout          = 2 * time.Second
+	defaultOpenBrowserTimeout       = 10 * time.Second
+
+	defaultLocalServerReadHeaderTimeout = 10 * time.Second
+	defaultLocalServerReadTimeout       = 30 * time.Second
+	defaultLocalServerWriteTimeout      = 30 * time.Second
+	defaultLocalServerIdleTimeout       = 30 * time.Second
+)
+
+// ErrNoCallbackActivity is returned if no request reached the local server within AuthCodeFlow.NoCallbackActivityTimeout.
+// This usually means the browser did not load the page, e.g. in a non-interactive environment.
+var ErrNoCallbackActivity = errors.New("No request reached the local server. The browser may not have opened the page")
+
+var (
+	// ErrFlowTimeout is returned if the context reached the deadline, e.g. AuthCodeFlow.Timeout, during the flow.
+	// The error also wraps context.DeadlineExceeded.
+	ErrFlowTimeout = errors.New("Timed out")
+
+	// ErrUserCancelled is returned if the context is cancelled during the flow, e.g. by an interrupt signal.
+	// The error also wraps context.Canceled.
+	ErrUserCancelled = errors.New("Cancelled")
+
+	// ErrCancelled is returned if the flow is cancelled by the cancel function of Start, e.g. by a cancel button of UI.
+	// The error also wraps ErrUserCancelled and context.Canceled.
+	ErrCancelled = errors.New("Login cancelled")
+
+	// ErrMissingIDToken is returned if AuthCodeFlow.RequireIDToken is set but the provider did not return an ID token,
+	// including an empty one.
+	ErrMissingIDToken = errors.New("ID token is missing. The openid scope may not be requested or granted")
+
+	// ErrStateMismatch is wrapped if the flow timed out or was cancelled after an authorization response was rejected,
+	// because its state parameter did not match the request, e.g. a callback of the previous flow.
+	// Such a response does not end the flow, so that a request from another process cannot interrupt the login.
+	ErrStateMismatch = errors.New("State does not match")
+)
+
+// ExchangeError is returned if the token request failed after the authorization code was received.
+// The caller can retry the token request by AuthCodeFlow.Exchange with the code,
+// by setting Config.RedirectURL to RedirectURL and Nonce to Nonce, without repeating the browser interaction.
+// Note that the provider may reject the code if it has expired or been used.
+type ExchangeError struct {
+	Code        string // Authorization code.
+	RedirectURL string // redirect_uri of the authorization request.
+	State       string // State parameter of the authorization request.
+	Nonce       string // Nonce parameter of the authorization request. Empty if it was not sent.
+	Err         error
+}
+
+// Error returns the message without the code.
+func (e *ExchangeError) Error() string { return fmt.Sprintf("Could not exchange token: %s", e.Err) }
+
+// Unwrap returns the error of the token request.
+func (e *ExchangeError) Unwrap() error { return e.Err }
+
+// newContextError returns the error of the context with the corresponding sentinel error.
+func newContextError(err error) error {
+	switch err {
+	case context.DeadlineExceeded:
+		return &sentinelError{ErrFlowTimeout, err}
+	case context.Canceled:
+		return &sentinelError{ErrUserCancelled, err}
+	}
+	return err
 }
 
 // GetToken performs Authorization Grant Flow and returns a token got from the provider.
@@ -33,101 +343,1227 @@ type AuthCodeFlow struct {
 // 5. Exchange the code and a token.
 // 6. Return the code.
 //
-// Note that this will change Config.RedirectURL to "http://localhost:port" if it is empty.
+// The token has all members of the token response including non-standard ones,
+// which are available via Token.Extra(), e.g. token.Extra("resource_server").
+// Token.TokenType is normalized to "Bearer" if it is bearer in any case,
+// and the original value is available via token.Extra("token_type").
+//
+// If Config.RedirectURL is empty, "http://localhost:port" is used as the redirect URL.
+// If UseTLS is true, it will be "https://localhost:port" instead.
+// The hostname can be changed by RedirectURLHostname.
+// Otherwise Config.RedirectURL is sent verbatim as redirect_uri of both the authorization request and token request,
+// so it must exactly match the registered one, including a trailing slash.
+//
+// If the context is done while waiting for the authorization response,
+// the local server responds the cancellation page to a pending callback before shutting down.
+//
+// This does not modify the flow. Each call has its own local server and state,
+// so you can call this concurrently, as long as LocalServerPort does not conflict.
 //
 func (f *AuthCodeFlow) GetToken(ctx context.Context) (*oauth2.Token, error) {
-	listener, err := newLocalhostListener(f.LocalServerPort)
+	r, err := f.GetTokenResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// GetTokenResult performs the flow as well as GetToken,
+// and returns the result including the granted scopes, state and ID token.
+func (f *AuthCodeFlow) GetTokenResult(ctx context.Context) (*Result, error) {
+	events := newEventDispatcher(f.EventHandler)
+	defer events.close()
+	r, err := f.getToken(ctx, events)
+	events.emit(Event{Type: EventDone, Err: err})
+	return r, err
+}
+
+func (f *AuthCodeFlow) getToken(ctx context.Context, events *eventDispatcher) (*Result, error) {
+	ctx, cancel := f.withTimeout(ctx)
+	defer cancel()
+	listener, config, err := f.listenAndConfigure(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state, err := f.state()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	nonce, err := f.nonce(&config)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return f.run(ctx, listener, &config, state, nonce, events)
+}
+
+// run performs the flow on the listener and closes it when finished.
+func (f *AuthCodeFlow) run(ctx context.Context, listener *localhostListener, config *oauth2.Config, state, nonce string, events *eventDispatcher) (*Result, error) {
+	defer listener.Close()
+	authorizationStart := time.Now()
+	resp, finish, err := f.getCode(ctx, config, listener, state, nonce, events)
+	f.observeAuthorization(authorizationStart, err)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get an auth code: %w", err)
+	}
+	r, err := f.exchangeCode(ctx, config, state, nonce, resp, events)
+	finish(r, err)
+	return r, err
+}
+
+// exchangeCode sends the token request with the authorization response, and returns the result.
+func (f *AuthCodeFlow) exchangeCode(ctx context.Context, config *oauth2.Config, state, nonce string, resp authorizationResponse, events *eventDispatcher) (*Result, error) {
+	events.emit(Event{Type: EventCodeReceived})
+	if f.OnCodeReceived != nil {
+		f.OnCodeReceived()
+	}
+	events.emit(Event{Type: EventExchanging})
+	exchangeStart := time.Now()
+	tr, err := f.exchange(ctx, config, resp.Code)
+	f.observeTokenExchange(exchangeStart, err)
+	if err != nil {
+		return nil, &ExchangeError{Code: resp.Code, RedirectURL: config.RedirectURL, State: state, Nonce: nonce, Err: err}
+	}
+	r := newResult(tr, state, resp.IDToken)
+	r.Nonce = nonce
+	if err := f.verifyIDToken(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// verifyIDToken checks the ID token of the result as RequireIDToken and IDTokenVerifier,
+// and the nonce claim against Result.Nonce if it is set.
+// If IDTokenVerifier is set, Result.IDTokenClaims is replaced with the verified claims.
+func (f *AuthCodeFlow) verifyIDToken(ctx context.Context, r *Result) error {
+	if (f.RequireIDToken || f.IDTokenVerifier != nil) && r.IDToken == "" {
+		return fmt.Errorf("Could not exchange token: %w", ErrMissingIDToken)
+	}
+	if f.IDTokenVerifier != nil {
+		claims, err := f.IDTokenVerifier.Verify(ctx, r.IDToken, r.Nonce)
+		if err != nil {
+			return fmt.Errorf("Could not verify the ID token: %w", err)
+		}
+		r.IDTokenClaims = claims
+		return nil
+	}
+	if r.Nonce != "" && r.IDToken != "" {
+		if got, _ := r.IDTokenClaims["nonce"].(string); got != r.Nonce {
+			return fmt.Errorf("Could not verify the ID token: %w: nonce did not match", ErrInvalidIDToken)
+		}
+	}
+	return nil
+}
+
+// withTimeout returns a context which is done when Timeout elapses, if it is set.
+// The flow creates it once, so that Timeout applies to the discovery, authorization and token request in total.
+func (f *AuthCodeFlow) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.Timeout > 0 {
+		return context.WithTimeout(ctx, f.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (f *AuthCodeFlow) logger() Logger {
+	if f.Logger == nil {
+		return DefaultLogger
+	}
+	return f.Logger
+}
+
+// AuthCodeURL returns the URL of the authorization request, without starting the local server or opening the browser.
+// It binds a listener to determine the redirect URL and closes it before return.
+// If Listener is set, the redirect URL is determined from its address, and it is left open.
+//
+// The state parameter in the URL is generated for each call unless State is set,
+// and it is not accepted by another call of GetToken.
+func (f *AuthCodeFlow) AuthCodeURL(ctx context.Context) (string, error) {
+	flow := *f
+	if flow.Listener != nil {
+		flow.Listener = &unclosableListener{flow.Listener}
+	}
+	return flow.authCodeURLWithListener(ctx)
+}
+
+func (f *AuthCodeFlow) authCodeURLWithListener(ctx context.Context) (string, error) {
+	ctx, cancel := f.withTimeout(ctx)
+	defer cancel()
+	listener, config, err := f.listenAndConfigure(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Could not listen to port: %s", err)
+		return "", err
 	}
 	defer listener.Close()
-	if f.Config.RedirectURL == "" {
-		f.Config.RedirectURL = listener.URL
+	state, err := f.state()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := f.nonce(&config)
+	if err != nil {
+		return "", err
+	}
+	return f.authCodeURL(&config, state, nonce), nil
+}
+
+// Start starts the local server and returns the URL of the authorization request immediately,
+// without opening the browser or blocking.
+// This is useful for an application which navigates to the URL by itself, e.g. in a webview.
+//
+// The result of the flow is sent to the channel once, and then the channel is closed.
+// Call cancel to abort the flow, which also releases the resources after the result.
+// If the flow is aborted by cancel, the result has an error which wraps ErrCancelled.
+// ShowLocalServerURL is not called, and SkipOpenBrowser is ignored.
+func (f *AuthCodeFlow) Start(ctx context.Context) (authURL string, result <-chan Result, cancel func(), err error) {
+	flow := *f
+	flow.SkipOpenBrowser = true
+	flow.ShowLocalServerURL = func(string) {}
+	ctx, cancelFunc := flow.withTimeout(ctx)
+	listener, config, err := flow.listenAndConfigure(ctx)
+	if err != nil {
+		cancelFunc()
+		return "", nil, nil, err
 	}
-	code, err := f.getCode(ctx, listener)
+	state, err := flow.state()
 	if err != nil {
-		return nil, fmt.Errorf("Could not get an auth code: %s", err)
+		listener.Close()
+		cancelFunc()
+		return "", nil, nil, err
 	}
-	token, err := f.Config.Exchange(ctx, code)
+	nonce, err := flow.nonce(&config)
 	if err != nil {
-		return nil, fmt.Errorf("Could not exchange token: %s", err)
+		listener.Close()
+		cancelFunc()
+		return "", nil, nil, err
 	}
-	return token, nil
+	var cancelled int32
+	cancel = func() {
+		atomic.StoreInt32(&cancelled, 1)
+		cancelFunc()
+	}
+	resultCh := make(chan Result, 1)
+	go func() {
+		defer close(resultCh)
+		defer cancelFunc()
+		events := newEventDispatcher(flow.EventHandler)
+		defer events.close()
+		r, err := flow.run(ctx, listener, &config, state, nonce, events)
+		if err != nil && atomic.LoadInt32(&cancelled) != 0 && errors.Is(err, context.Canceled) {
+			err = &sentinelError{ErrCancelled, err}
+		}
+		events.emit(Event{Type: EventDone, Err: err})
+		if err != nil {
+			resultCh <- Result{Err: err}
+			return
+		}
+		resultCh <- *r
+	}()
+	return flow.authCodeURL(&config, state, nonce), resultCh, cancel, nil
 }
 
-func (f *AuthCodeFlow) getCode(ctx context.Context, listener *localhostListener) (string, error) {
-	state, err := newOAuth2State()
+// Exchange sends a token request with the code, without starting the local server.
+// This is useful if the code is received by other means, e.g. pasted by the user.
+//
+// Config.RedirectURL must be the redirect URL of the authorization request,
+// because the provider verifies that redirect_uri of the token request is identical.
+// Timeout, TokenRequestTimeout, retries and the token type normalization are applied as well as GetToken.
+// The ID token is checked by RequireIDToken and IDTokenVerifier as well,
+// and its nonce claim must be identical to Nonce if it is set, e.g. the one of the authorization request.
+func (f *AuthCodeFlow) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	ctx, cancel := f.withTimeout(ctx)
+	defer cancel()
+	config, err := f.configure(ctx)
 	if err != nil {
-		return "", fmt.Errorf("Could not generate state parameter: %s", err)
+		return nil, err
+	}
+	if err := checkTokenURL(config.Endpoint.TokenURL); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	tr, err := f.exchange(ctx, &config, code)
+	f.observeTokenExchange(start, err)
+	if err != nil {
+		return nil, fmt.Errorf("Could not exchange token: %w", err)
+	}
+	r := newResult(tr, "", "")
+	r.Nonce = f.Nonce
+	if err := f.verifyIDToken(ctx, r); err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// listenAndConfigure starts a listener of the local server,
+// and returns the config which has the redirect URL to the local server.
+// The caller must close the listener.
+func (f *AuthCodeFlow) listenAndConfigure(ctx context.Context) (*localhostListener, oauth2.Config, error) {
+	config, err := f.configure(ctx)
+	if err != nil {
+		return nil, config, err
+	}
+	// Check the configuration before the browser interaction, because the token request is sent after it.
+	if err := checkTokenURL(config.Endpoint.TokenURL); err != nil {
+		return nil, config, err
+	}
+	if f.LocalServerCallbackPath != "" && !strings.HasPrefix(f.LocalServerCallbackPath, "/") {
+		return nil, config, fmt.Errorf("LocalServerCallbackPath must start with / but %s", f.LocalServerCallbackPath)
+	}
+	scheme := "http"
+	if f.useTLS() {
+		scheme = "https"
+	}
+	listener, err := f.listen(scheme)
+	if err != nil {
+		return nil, config, fmt.Errorf("Could not start the local server: %w", err)
+	}
+	if listener.URL != "" && f.RedirectURLHostname != "" {
+		listener.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(f.RedirectURLHostname, strconv.Itoa(listener.Port)))
+	}
+	if config.RedirectURL == "" {
+		if listener.URL == "" {
+			listener.Close()
+			return nil, config, fmt.Errorf("Config.RedirectURL is required for the listener on %s", listener.Addr())
+		}
+		config.RedirectURL = listener.URL + f.LocalServerCallbackPath
+	} else if listener.URL != "" && f.LocalServerCallbackPath == "" {
+		if err := checkRedirectURL(config.RedirectURL, listener.URL); err != nil {
+			if f.StrictRedirectCheck {
+				listener.Close()
+				return nil, config, err
+			}
+			f.logger().Log(LogMessage{
+				Event:   "redirect_url_mismatch",
+				Message: fmt.Sprintf("Warning: %s", err),
+				Fields:  map[string]string{"redirect_url": config.RedirectURL, "url": listener.URL, "error": err.Error()},
+			})
+		}
+	}
+	for _, scope := range config.Scopes {
+		if err := checkScope(scope); err != nil {
+			f.logger().Log(LogMessage{
+				Event:   "scope_malformed",
+				Message: fmt.Sprintf("Warning: %s", err),
+				Fields:  map[string]string{"scope": scope, "error": err.Error()},
+			})
+		}
+	}
+	if listener.URL == "" {
+		// The local server is reachable only via the redirect URL.
+		u, err := url.Parse(config.RedirectURL)
+		if err != nil {
+			listener.Close()
+			return nil, config, fmt.Errorf("Invalid Config.RedirectURL: %w", err)
+		}
+		listener.URL = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	}
+	return listener, config, nil
+}
+
+// configure returns a copy of the config.
+// If Issuer is set and the endpoint is empty, it resolves the endpoint by the discovery.
+func (f *AuthCodeFlow) configure(ctx context.Context) (oauth2.Config, error) {
+	config := f.Config
+	if f.Issuer == "" || config.Endpoint != (oauth2.Endpoint{}) {
+		return config, nil
+	}
+	m, err := discover(ctx, httpClient(ctx, f.HTTPClient), f.Issuer)
+	if err != nil {
+		return config, fmt.Errorf("Could not discover the endpoint: %w", err)
+	}
+	if err := m.checkEndpoint(); err != nil {
+		return config, err
+	}
+	config.Endpoint = m.Endpoint()
+	return config, nil
+}
+
+// listen returns the listener of the local server.
+func (f *AuthCodeFlow) listen(scheme string) (*localhostListener, error) {
+	if f.Listener != nil {
+		return newCustomListener(f.Listener, scheme), nil
+	}
+	host := listenHost(f.RedirectURLHostname)
+	if f.LocalServerBindAddress != "" {
+		host = f.LocalServerBindAddress
+	}
+	if len(f.LocalServerPorts) > 0 {
+		return newLocalhostListenerOnPorts(host, f.LocalServerPorts, scheme)
+	}
+	return newLocalhostListener(host, f.LocalServerPort, scheme)
+}
+
+// exchange sends a token request with the code.
+// It retries the request on a transient error up to TokenRequestMaxAttempts.
+// It returns the token and all members of the response.
+func (f *AuthCodeFlow) exchange(ctx context.Context, config *oauth2.Config, code string) (*tokenResponse, error) {
+	if code == "" {
+		return nil, errors.New("Code is empty")
+	}
+	backoff := f.TokenRequestRetryBackoff
+	if backoff == 0 {
+		backoff = defaultTokenRequestRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		tr, err := f.exchangeOnce(ctx, config, code)
+		if err == nil {
+			normalizeTokenType(tr.Token)
+			if f.LogTokenResponse {
+				f.logger().Log(newTokenResponseLogMessage(tr.Token, tr.Raw))
+			}
+			return tr, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Context done while sending the token request: %s: %w", wrapTokenError(err), newContextError(ctx.Err()))
+		}
+		delay, ok := retryDelay(err, backoff)
+		if !ok || attempt >= f.TokenRequestMaxAttempts {
+			return nil, wrapTokenError(err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Context done while waiting for retry of %s: %w", wrapTokenError(err), newContextError(ctx.Err()))
+		}
+		backoff *= 2
+	}
+}
+
+func (f *AuthCodeFlow) exchangeOnce(ctx context.Context, config *oauth2.Config, code string) (*tokenResponse, error) {
+	timeout := f.TokenRequestTimeout
+	if timeout == 0 {
+		timeout = defaultTokenRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	v := f.extraTokenRequestParams()
+	v.Set("grant_type", f.grantType())
+	v.Set("code", code)
+	if config.RedirectURL != "" {
+		v.Set("redirect_uri", config.RedirectURL)
+	} else {
+		v.Del("redirect_uri")
+	}
+	style := f.AuthStyle
+	if f.ClientAssertion != nil {
+		if err := setClientAssertion(v, f.ClientAssertion, config); err != nil {
+			return nil, err
+		}
+		style = authStyleNone
+	}
+	return tokenExchangeAutoDetect(ctx, httpClient(ctx, f.HTTPClient), config, v, style, f.AuthStyleCache, f.TokenRequestEncoder)
+}
+
+// getCode starts the local server and waits for the authorization response.
+// The caller must call the returned function with the result of the token exchange,
+// which shuts down the local server if WaitForTokenExchange or SuccessTemplate is set.
+func (f *AuthCodeFlow) getCode(ctx context.Context, config *oauth2.Config, listener *localhostListener, state, nonce string, events *eventDispatcher) (authorizationResponse, func(*Result, error), error) {
+	// These channels are buffered and never closed,
+	// because the handler may be called even after this function returned.
+	// A value is dropped if the buffer is full, i.e. only the first result is received.
+	codeCh := make(chan authorizationResponse, 1)
+	errCh := make(chan error, 1)
+	sendErr := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	// Set if a response with another state was rejected, e.g. a callback from the previous flow.
+	var stateMismatched int32
+	callbackPath := f.callbackPath(config.RedirectURL)
+	statusPath := path.Join(path.Dir(callbackPath), "status")
+	handler := &authCodeFlowHandler{
+		authCodeURL:  f.authCodeURL(config, state, nonce),
+		callbackPath: callbackPath,
+		statusPath:   statusPath,
+		state:        state,
+		success:      f.successResponse(statusPath),
+		errorHTML:    f.LocalServerErrorHTML,
+		fallback:     f.FallbackHandler,
+		paramNames:   f.ResponseParamNames,
+		gotCode: func(resp authorizationResponse) {
+			select {
+			case codeCh <- resp:
+			default:
+			}
+		},
+		gotError: sendErr,
+		gotInvalid: func(err error) {
+			if errors.Is(err, ErrStateMismatch) {
+				atomic.StoreInt32(&stateMismatched, 1)
+			}
+			f.logger().Log(LogMessage{
+				Event:   "authorization_response_rejected",
+				Message: fmt.Sprintf("Rejected the authorization response: %s", err),
+				Fields:  map[string]string{"error": err.Error()},
+			})
+		},
+	}
+	if f.waitForTokenExchange() || f.SuccessTemplate != nil {
+		handler.status = newExchangeStatus()
+		handler.template = f.SuccessTemplate
+		handler.logger = f.logger()
+	}
+	var serverHandler http.Handler = handler
+	if f.Middleware != nil {
+		serverHandler = f.Middleware(handler)
+	}
+	if f.AuditLog != nil {
+		serverHandler = auditHandler(serverHandler, f.AuditLog)
 	}
-	codeCh := make(chan string)
-	defer close(codeCh)
-	errCh := make(chan error)
-	defer close(errCh)
 	server := http.Server{
-		Handler: &authCodeFlowHandler{
-			authCodeURL: f.Config.AuthCodeURL(string(state), f.AuthCodeOptions...),
-			gotCode: func(code string, gotState string) {
-				if gotState == state {
-					codeCh <- code
-				} else {
-					errCh <- fmt.Errorf("State does not match, wants %s but %s", state, gotState)
-				}
-			},
-			gotError: func(err error) {
-				errCh <- err
-			},
+		Handler:           serverHandler,
+		ReadHeaderTimeout: durationOrDefault(f.LocalServerReadHeaderTimeout, defaultLocalServerReadHeaderTimeout),
+		ReadTimeout:       durationOrDefault(f.LocalServerReadTimeout, defaultLocalServerReadTimeout),
+		WriteTimeout:      durationOrDefault(f.LocalServerWriteTimeout, defaultLocalServerWriteTimeout),
+		IdleTimeout:       durationOrDefault(f.LocalServerIdleTimeout, defaultLocalServerIdleTimeout),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
 		},
 	}
-	defer server.Shutdown(ctx)
+	if f.useTLS() {
+		cert, err := f.tlsCertificate()
+		if err != nil {
+			return authorizationResponse{}, nil, err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	keepServer := false
+	defer func() {
+		if !keepServer {
+			f.shutdown(&server)
+		}
+	}()
+	// The listener is already bound, so a connection is queued until the server accepts it.
+	// The browser can be opened as soon as the server goroutine is about to serve.
+	readyCh := make(chan struct{})
 	go func() {
-		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			errCh <- err
+		close(readyCh)
+		var err error
+		if f.useTLS() {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			sendErr(err)
 		}
 	}()
+	events.emit(Event{Type: EventServerStarted, URL: listener.URL, AuthURL: handler.authCodeURL})
+	openURL := listener.URL
+	if f.OpenAuthURLDirectly {
+		openURL = handler.authCodeURL
+	}
+	openedCh := make(chan error, 1)
 	go func() {
-		time.Sleep(500 * time.Millisecond)
+		// Do not open the browser if the flow is already cancelled.
+		select {
+		case <-readyCh:
+		case <-ctx.Done():
+			openedCh <- ctx.Err()
+			return
+		}
+		if f.StartupDelay > 0 {
+			select {
+			case <-time.After(f.StartupDelay):
+			case <-ctx.Done():
+				openedCh <- ctx.Err()
+				return
+			}
+		}
+		if f.BeforeOpenBrowser != nil {
+			if err := f.BeforeOpenBrowser(handler.authCodeURL); err != nil {
+				sendErr(fmt.Errorf("Aborted before opening the browser: %w", err))
+				return
+			}
+		}
 		if f.ShowLocalServerURL != nil {
-			f.ShowLocalServerURL(listener.URL)
+			f.ShowLocalServerURL(openURL)
 		} else {
-			log.Printf("Open %s for authorization", listener.URL)
+			f.logger().Log(LogMessage{
+				Event:   "server_started",
+				Message: fmt.Sprintf("Open %s for authorization", openURL),
+				Fields:  map[string]string{"url": openURL},
+			})
 		}
-		if !f.SkipOpenBrowser {
-			browser.OpenURL(listener.URL)
+		if f.SkipOpenBrowser || !f.Browser.shouldOpen() {
+			openedCh <- nil
+			return
 		}
+		if err := f.openBrowser(ctx, openURL); err != nil {
+			// The user can still open the URL manually.
+			f.logger().Log(LogMessage{
+				Event:   "browser_open_failed",
+				Message: fmt.Sprintf("Could not open the browser: %s. Open %s in your browser manually", err, openURL),
+				Fields:  map[string]string{"url": openURL, "error": err.Error()},
+			})
+			openedCh <- fmt.Errorf("Could not open the browser: %w", err)
+			return
+		}
+		openedCh <- nil
+	}()
+	var noActivityCh <-chan time.Time
+	for {
+		select {
+		case err := <-openedCh:
+			openedCh = nil
+			events.emit(Event{Type: EventBrowserOpened, URL: openURL, Err: err, AuthURL: handler.authCodeURL})
+			events.emit(Event{Type: EventWaiting})
+			// The browser does not reach the local server until the callback if it opens the authorization URL directly.
+			if f.NoCallbackActivityTimeout > 0 && !f.OpenAuthURLDirectly {
+				noActivityCh = time.After(f.NoCallbackActivityTimeout)
+			}
+		case <-noActivityCh:
+			noActivityCh = nil
+			if !handler.hasActivity() {
+				return authorizationResponse{}, nil, ErrNoCallbackActivity
+			}
+		case err := <-errCh:
+			return authorizationResponse{}, nil, err
+		case resp := <-codeCh:
+			if handler.status == nil {
+				handler.finish()
+				return resp, func(*Result, error) {}, nil
+			}
+			keepServer = true
+			return resp, func(r *Result, err error) {
+				handler.finish()
+				handler.status.complete(r, err)
+				select {
+				case <-handler.status.fetched:
+				case <-time.After(durationOrDefault(f.ShutdownTimeout, defaultShutdownTimeout)):
+				}
+				f.shutdown(&server)
+			}, nil
+		case <-ctx.Done():
+			// A callback received during the shutdown will get the cancellation page.
+			handler.cancel()
+			err := newContextError(ctx.Err())
+			if atomic.LoadInt32(&stateMismatched) != 0 {
+				err = &sentinelError{ErrStateMismatch, err}
+			}
+			return authorizationResponse{}, nil, fmt.Errorf("Context done while waiting for authorization response: %w", err)
+		}
+	}
+}
+
+// openBrowser opens the URL in the browser.
+// It returns an error if the browser command did not return within OpenBrowserTimeout,
+// because it may hang on a machine without the desktop environment.
+func (f *AuthCodeFlow) openBrowser(ctx context.Context, u string) error {
+	// This is buffered because the command may return after the timeout.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- browser.OpenURL(u)
 	}()
 	select {
 	case err := <-errCh:
-		return "", err
-	case code := <-codeCh:
-		return code, nil
+		return err
+	case <-time.After(durationOrDefault(f.OpenBrowserTimeout, defaultOpenBrowserTimeout)):
+		return errors.New("Timed out opening the browser")
 	case <-ctx.Done():
-		return "", fmt.Errorf("Context done while waiting for authorization response: %s", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// checkScope returns an error if the element of Config.Scopes seems to contain multiple scopes.
+// Each scope should be an element, and they are joined by a space in the authorization request.
+func checkScope(scope string) error {
+	if strings.ContainsAny(scope, " ,") {
+		return fmt.Errorf("Config.Scopes has the element %q which contains a space or comma. Set each scope as an element, e.g. %q",
+			scope, strings.FieldsFunc(scope, func(r rune) bool { return r == ' ' || r == ',' }))
+	}
+	return nil
+}
+
+// checkRedirectURL returns an error if the redirect URL does not point to the local server.
+// Any loopback host is accepted, because the local server listens on localhost.
+// The host of the local server URL is accepted as well, i.e. RedirectURLHostname.
+func checkRedirectURL(redirectURL, localServerURL string) error {
+	r, err := url.Parse(redirectURL)
+	if err != nil {
+		return fmt.Errorf("Invalid Config.RedirectURL: %w", err)
+	}
+	l, err := url.Parse(localServerURL)
+	if err != nil {
+		return fmt.Errorf("Invalid local server URL: %w", err)
+	}
+	if r.Scheme != l.Scheme || urlPort(r) != urlPort(l) || (!isLoopbackHost(r.Hostname()) && r.Hostname() != l.Hostname()) {
+		return fmt.Errorf("Config.RedirectURL %s does not point to the local server %s", redirectURL, localServerURL)
+	}
+	return nil
+}
+
+// urlPort returns the port of the URL, or the default port of the scheme.
+func urlPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// callbackPath returns the path of the local server which receives the authorization response.
+// It is the path of the redirect URL unless LocalServerCallbackPath is set.
+func (f *AuthCodeFlow) callbackPath(redirectURL string) string {
+	if f.LocalServerCallbackPath != "" {
+		return f.LocalServerCallbackPath
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+const (
+	successHTML          = `<html><body>Authentication complete. You may close this tab and return to the terminal.</body></html>`
+	successHTMLAutoClose = `<html><body>Authentication complete. You may close this tab and return to the terminal.<script>window.close()</script></body></html>`
+)
+
+// successHTMLWaitForTokenExchange returns the page which shows the status of the token exchange.
+// The status path is absolute, because the page is also served at the root, e.g. when the user navigates back.
+func successHTMLWaitForTokenExchange(statusPath string, autoClose bool) string {
+	closeScript := ""
+	if autoClose {
+		closeScript = "window.close();"
+	}
+	return `<html><body><p id="message">Completing the login. Wait a moment...</p><script>
+var message = document.getElementById("message");
+fetch("` + template.JSEscapeString(statusPath) + `").then(function (r) { return r.json(); }).then(function (s) {
+	if (s.status !== "ok") {
+		message.textContent = "Login failed. Return to the terminal for the details.";
+		return;
+	}
+	message.textContent = "Authentication complete. You may close this tab and return to the terminal.";
+	` + closeScript + `
+}).catch(function () {
+	message.textContent = "Return to the terminal.";
+});
+</script></body></html>`
+}
+
+// SuccessResponse represents the response of the local server after the authorization.
+type SuccessResponse struct {
+	StatusCode  int    // Default to 200.
+	ContentType string // Default to text/html.
+	Body        []byte
+}
+
+func (r SuccessResponse) write(w http.ResponseWriter) {
+	contentType := r.ContentType
+	if contentType == "" {
+		contentType = "text/html"
+	}
+	statusCode := r.StatusCode
+	if statusCode == 0 {
+		statusCode = 200
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(r.Body)
+}
+
+// successResponse returns the response shown after the authorization.
+func (f *AuthCodeFlow) successResponse(statusPath string) SuccessResponse {
+	if f.SuccessResponse != nil {
+		return *f.SuccessResponse
+	}
+	if f.waitForTokenExchange() {
+		return SuccessResponse{Body: []byte(successHTMLWaitForTokenExchange(statusPath, !f.SkipAutoClose))}
+	}
+	if f.SkipAutoClose {
+		return SuccessResponse{Body: []byte(successHTML)}
+	}
+	return SuccessResponse{Body: []byte(successHTMLAutoClose)}
+}
+
+// waitForTokenExchange returns true if the success page fetches the status of the token exchange.
+// SuccessResponse takes precedence over the page.
+func (f *AuthCodeFlow) waitForTokenExchange() bool {
+	return f.WaitForTokenExchange && f.SuccessResponse == nil
+}
+
+// shutdown gracefully stops the server.
+// This uses another context from the flow, because the flow context may be already done
+// and then the response to the browser would be cut off.
+func (f *AuthCodeFlow) shutdown(server *http.Server) {
+	timeout := f.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// state returns the state parameter for the authorization request.
+// It is passed to SaveState if set.
+func (f *AuthCodeFlow) state() (string, error) {
+	state, err := f.generateState()
+	if err != nil {
+		return "", fmt.Errorf("Could not generate state parameter: %s", err)
+	}
+	// An empty state would be validated inconsistently, because some providers omit it in the response.
+	if state == "" {
+		return "", errors.New("Could not generate state parameter: StateGenerator returned an empty string")
+	}
+	if f.SaveState != nil {
+		if err := f.SaveState(state); err != nil {
+			return "", fmt.Errorf("Could not save state parameter: %w", err)
+		}
+	}
+	return state, nil
+}
+
+func (f *AuthCodeFlow) generateState() (string, error) {
+	if f.State != "" {
+		return f.State, nil
+	}
+	if f.StateGenerator != nil {
+		return f.StateGenerator()
+	}
+	return newOAuth2State()
+}
+
+// nonce returns the nonce parameter for the authorization request, or empty if the openid scope is not requested.
+func (f *AuthCodeFlow) nonce(config *oauth2.Config) (string, error) {
+	if f.Nonce != "" {
+		return f.Nonce, nil
+	}
+	if !containsString(config.Scopes, "openid") {
+		return "", nil
+	}
+	nonce, err := newOAuth2State()
+	if err != nil {
+		return "", fmt.Errorf("Could not generate nonce parameter: %w", err)
+	}
+	return nonce, nil
+}
+
+// authCodeURL returns the URL of the authorization request.
+// The resource parameters are appended here,
+// because oauth2.SetAuthURLParam() cannot set multiple values of a parameter.
+func (f *AuthCodeFlow) authCodeURL(config *oauth2.Config, state, nonce string) string {
+	opts := f.authCodeOptions()
+	if nonce != "" {
+		opts = append([]oauth2.AuthCodeOption{oauth2.SetAuthURLParam("nonce", nonce)}, opts...)
+	}
+	u := config.AuthCodeURL(state, opts...)
+	if len(f.Resources) > 0 {
+		u += "&" + url.Values{"resource": f.Resources}.Encode()
+	}
+	return u
+}
+
+// authCodeOptions returns the options passed to AuthCodeURL().
+// AuthCodeOptions take precedence over the parameters of the fields.
+func (f *AuthCodeFlow) authCodeOptions() []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	if prompt := f.prompt(); prompt != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", prompt))
+	}
+	if f.LoginHint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", f.LoginHint))
+	}
+	if f.Audience != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("audience", f.Audience))
+	}
+	if f.ResponseType != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("response_type", f.ResponseType))
+		if f.ResponseType != "code" {
+			// The default response mode of a hybrid flow is fragment, which does not reach the local server.
+			opts = append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+		}
+	}
+	return append(opts, f.AuthCodeOptions...)
+}
+
+func (f *AuthCodeFlow) grantType() string {
+	if f.GrantType == "" {
+		return "authorization_code"
+	}
+	return f.GrantType
+}
+
+// extraTokenRequestParams returns the form parameters of the token request except the standard ones.
+func (f *AuthCodeFlow) extraTokenRequestParams() url.Values {
+	v := url.Values{}
+	for key, values := range f.TokenRequestParams {
+		v[key] = append([]string(nil), values...)
 	}
+	if f.Audience != "" {
+		v.Set("audience", f.Audience)
+	}
+	for _, resource := range f.Resources {
+		v.Add("resource", resource)
+	}
+	return v
+}
+
+// prompt returns the space delimited values of the prompt parameter.
+func (f *AuthCodeFlow) prompt() string {
+	values := strings.Fields(f.Prompt)
+	if f.ForceLogin && !containsString(values, "login") {
+		values = append(values, "login")
+	}
+	return strings.Join(values, " ")
+}
+
+func (f *AuthCodeFlow) useTLS() bool {
+	return f.UseTLS || f.LocalServerCertFile != ""
+}
+
+func (f *AuthCodeFlow) tlsCertificate() (tls.Certificate, error) {
+	if len(f.TLSCert) > 0 {
+		cert, err := tls.X509KeyPair(f.TLSCert, f.TLSKey)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Could not load the certificate: %s", err)
+		}
+		return cert, nil
+	}
+	if f.LocalServerCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.LocalServerCertFile, f.LocalServerKeyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Could not load the certificate: %s", err)
+		}
+		return cert, nil
+	}
+	cert, err := newSelfSignedCertificate()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Could not generate a self-signed certificate: %s", err)
+	}
+	return cert, nil
+}
+
+// auditHandler calls the audit log after the handler responded to each request.
+func auditHandler(h http.Handler, auditLog func(method, path, remoteAddr string, accepted bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(sw, r)
+		auditLog(r.Method, r.URL.Path, r.RemoteAddr, sw.status < 400)
+	})
+}
+
+// statusRecorder records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// exchangeStatus represents the result of the token exchange, served to the success page.
+type exchangeStatus struct {
+	done      chan struct{} // closed when the token exchange is completed
+	err       error         // set before done is closed
+	fetched   chan struct{} // closed when the result is served
+	isFetched int32
+	result    *Result // set before done is closed, if the token exchange succeeded
+}
+
+func newExchangeStatus() *exchangeStatus {
+	return &exchangeStatus{done: make(chan struct{}), fetched: make(chan struct{})}
+}
+
+// complete sets the result of the token exchange. This must be called once.
+func (s *exchangeStatus) complete(r *Result, err error) {
+	s.result, s.err = r, err
+	close(s.done)
+}
+
+func (s *exchangeStatus) markFetched() {
+	if atomic.CompareAndSwapInt32(&s.isFetched, 0, 1) {
+		close(s.fetched)
+	}
+}
+
+// serveHTTP responds the result after the token exchange is completed.
+// The error is not shown to the browser, because the terminal shows it.
+func (s *exchangeStatus) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	clearWriteDeadline(r)
+	select {
+	case <-s.done:
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if s.err != nil {
+		fmt.Fprint(w, `{"status":"error"}`)
+	} else {
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}
+	s.markFetched()
+}
+
+// connContextKey is the key of the connection in the request context.
+type connContextKey struct{}
+
+// clearWriteDeadline removes the write deadline of the connection of the request,
+// so that LocalServerWriteTimeout does not cut off the response waiting for the token exchange.
+// The server sets the deadline again on the next request of the connection.
+func clearWriteDeadline(r *http.Request) {
+	if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// SuccessTemplateData represents the data to execute AuthCodeFlow.SuccessTemplate.
+// It does not contain the token, so that the template cannot show it by mistake.
+type SuccessTemplateData struct {
+	GrantedScopes []string               // Scopes in the token response. Nil if the provider granted the requested scopes as-is.
+	IDTokenClaims map[string]interface{} // Claims of the ID token without verification, e.g. email. Nil if no ID token.
+	Error         string                 // Set if the token exchange failed.
+}
+
+// writeTemplate responds the success page by the template after the token exchange is completed.
+// It always writes a page, so that the browser does not show a blank page.
+func (h *authCodeFlowHandler) writeTemplate(w http.ResponseWriter, r *http.Request) {
+	clearWriteDeadline(r)
+	select {
+	case <-h.status.done:
+	case <-r.Context().Done():
+		h.writeError(w, 503, "Return to the terminal for the result.")
+		return
+	}
+	defer h.status.markFetched()
+	var data SuccessTemplateData
+	if h.status.err != nil {
+		data.Error = h.status.err.Error()
+	} else if h.status.result != nil {
+		data.GrantedScopes = h.status.result.GrantedScopes
+		data.IDTokenClaims = h.status.result.IDTokenClaims
+	}
+	var b bytes.Buffer
+	if err := h.template.Execute(&b, data); err != nil {
+		h.logger.Log(LogMessage{
+			Event:   "success_template_failed",
+			Message: fmt.Sprintf("Could not execute the success template: %s", err),
+			Fields:  map[string]string{"error": err.Error()},
+		})
+		if h.status.err != nil {
+			h.writeError(w, 500, "Login failed. Return to the terminal for the details.")
+			return
+		}
+		h.success.write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// ResponseParamNames represents the names of the parameters of an authorization response.
+// An empty field is the standard name.
+type ResponseParamNames struct {
+	Code             string // Default to code.
+	State            string // Default to state.
+	Error            string // Default to error.
+	ErrorDescription string // Default to error_description.
+}
+
+func (n ResponseParamNames) withDefaults() ResponseParamNames {
+	if n.Code == "" {
+		n.Code = "code"
+	}
+	if n.State == "" {
+		n.State = "state"
+	}
+	if n.Error == "" {
+		n.Error = "error"
+	}
+	if n.ErrorDescription == "" {
+		n.ErrorDescription = "error_description"
+	}
+	return n
+}
+
+// authorizationResponse represents the parameters of an authorization response.
+type authorizationResponse struct {
+	Code    string
+	State   string
+	IDToken string // Set in a hybrid flow, e.g. response_type=code id_token.
 }
 
 type authCodeFlowHandler struct {
-	authCodeURL string
-	gotCode     func(code string, state string)
-	gotError    func(err error)
+	authCodeURL  string
+	callbackPath string
+	statusPath   string
+	state        string
+	success      SuccessResponse
+	errorHTML    string             // optional
+	fallback     http.Handler       // optional
+	paramNames   ResponseParamNames // optional
+	status       *exchangeStatus    // optional, set if WaitForTokenExchange or SuccessTemplate
+	template     *template.Template // optional
+	logger       Logger             // optional, set if template is set
+	gotCode      func(resp authorizationResponse)
+	gotError     func(err error)
+	gotInvalid   func(err error) // optional, called if an invalid response is rejected without ending the flow
+	activity     int32           // set to 1 when any request is received
+	cancelled    int32           // set to 1 when the flow is cancelled
+	completed    int32           // set to 1 when the code is received
+	finished     int32           // set to 1 when the flow took the code, or got the result of the token exchange if the server is kept
+
+	mu            sync.Mutex
+	responded     bool   // set when the first valid authorization response is received
+	respondedCode string // code of the first valid authorization response
+}
+
+// responseKind represents how a valid authorization response is handled.
+type responseKind int
+
+const (
+	firstResponse     responseKind = iota
+	duplicateResponse              // the same code as the first response, e.g. by a double click or prefetch
+	replayedResponse               // any other response after the first response
+)
+
+// accept returns the kind of the valid authorization response with the code.
+// Only the first response is processed, i.e. the state is single-use.
+// The same code is accepted as a duplicate until the flow is finished.
+func (h *authCodeFlowHandler) accept(code string) responseKind {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.responded {
+		h.responded, h.respondedCode = true, code
+		return firstResponse
+	}
+	if code != "" && code == h.respondedCode && atomic.LoadInt32(&h.finished) == 0 {
+		return duplicateResponse
+	}
+	return replayedResponse
+}
+
+// finish makes the handler reject any authorization response, including the same one.
+func (h *authCodeFlowHandler) finish() {
+	atomic.StoreInt32(&h.finished, 1)
+}
+
+// reject writes the error page for an invalid authorization response.
+// It does not end the flow, so that a request from another process cannot interrupt the login.
+func (h *authCodeFlowHandler) reject(w http.ResponseWriter, err error) {
+	if h.gotInvalid != nil {
+		h.gotInvalid(err)
+	}
+	h.writeError(w, 400, "Invalid authorization response")
+}
+
+// cancel makes the handler respond the cancellation page to any request.
+func (h *authCodeFlowHandler) cancel() {
+	atomic.StoreInt32(&h.cancelled, 1)
+}
+
+// isCallbackPath returns true if the path is the callback path.
+// A trailing slash is ignored, because some providers append it to the redirect URL.
+func (h *authCodeFlowHandler) isCallbackPath(p string) bool {
+	return strings.TrimSuffix(p, "/") == strings.TrimSuffix(h.callbackPath, "/")
+}
+
+// hasActivity returns true if the handler has received any request.
+func (h *authCodeFlowHandler) hasActivity() bool {
+	return atomic.LoadInt32(&h.activity) != 0
+}
+
+// writeError writes the error page, or the message in plain text if the page is not set.
+func (h *authCodeFlowHandler) writeError(w http.ResponseWriter, code int, message string) {
+	if h.errorHTML == "" {
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprint(w, h.errorHTML)
 }
 
 func (h *authCodeFlowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.StoreInt32(&h.activity, 1)
+	if atomic.LoadInt32(&h.cancelled) != 0 {
+		h.writeError(w, 503, "Login cancelled. Return to the terminal.")
+		return
+	}
 	q := r.URL.Query()
+	if r.Method == "POST" && h.isCallbackPath(r.URL.Path) {
+		// The authorization response is sent in the form body if response_mode=form_post.
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+		q = r.PostForm
+	}
+	isCallback := (r.Method == "GET" || r.Method == "POST") && h.isCallbackPath(r.URL.Path)
+	params := h.paramNames.withDefaults()
 	switch {
-	case r.Method == "GET" && r.URL.Path == "/" && q.Get("error") != "":
-		h.gotError(fmt.Errorf("OAuth Error: %s %s", q.Get("error"), q.Get("error_description")))
-		http.Error(w, "OAuth Error", 500)
+	case isCallback && (q.Get(params.Code) != "" || q.Get(params.Error) != ""):
+		h.serveResponse(w, r, q, params)
 
-	case r.Method == "GET" && r.URL.Path == "/" && q.Get("code") != "":
-		h.gotCode(q.Get("code"), q.Get("state"))
-		w.Header().Add("Content-Type", "text/html")
-		fmt.Fprintf(w, `<html><body>OK<script>window.close()</script></body></html>`)
+	case r.Method == "GET" && r.URL.Path == "/" && atomic.LoadInt32(&h.completed) != 0:
+		// Do not redirect again, e.g. when the user navigates back to the page.
+		h.success.write(w)
 
 	case r.Method == "GET" && r.URL.Path == "/":
 		http.Redirect(w, r, h.authCodeURL, 302)
 
+	case r.Method == "GET" && r.URL.Path == h.statusPath && h.status != nil:
+		h.status.serveHTTP(w, r)
+
+	case r.Method == "GET" && r.URL.Path == "/favicon.ico":
+		// Browsers may request the icon at any time, so respond without affecting the flow.
+		w.WriteHeader(204)
+
+	case h.fallback != nil:
+		h.fallback.ServeHTTP(w, r)
+
 	default:
 		http.Error(w, "Not Found", 404)
 	}
 }
+
+// serveResponse processes an authorization response.
+// An invalid response is rejected before it takes the slot of the first response.
+func (h *authCodeFlowHandler) serveResponse(w http.ResponseWriter, r *http.Request, q url.Values, params ResponseParamNames) {
+	code, state, errorCode := q.Get(params.Code), q.Get(params.State), q.Get(params.Error)
+	switch {
+	case code != "" && errorCode != "":
+		h.reject(w, fmt.Errorf("Invalid authorization response: both code and error are present"))
+		return
+	case state == "":
+		h.reject(w, fmt.Errorf("Invalid authorization response: state is missing"))
+		return
+	case state != h.state:
+		h.reject(w, fmt.Errorf("Invalid authorization response: %w, wants %s but %s", ErrStateMismatch, h.state, state))
+		return
+	}
+	switch h.accept(code) {
+	case replayedResponse:
+		h.writeError(w, 400, "The authorization response has already been used. Return to the terminal.")
+		return
+	case duplicateResponse:
+		h.success.write(w)
+		return
+	}
+	if errorCode != "" {
+		h.gotError(fmt.Errorf("OAuth Error: %s %s", errorCode, q.Get(params.ErrorDescription)))
+		h.writeError(w, 500, "OAuth Error")
+		return
+	}
+	h.gotCode(authorizationResponse{Code: code, State: state, IDToken: q.Get("id_token")})
+	atomic.StoreInt32(&h.completed, 1)
+	if h.template != nil {
+		h.writeTemplate(w, r)
+		return
+	}
+	h.success.write(w)
+}
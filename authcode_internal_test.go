@@ -0,0 +1,430 @@
+package oauth2cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthCodeFlowHandler_Cancelled(t *testing.T) {
+	h := &authCodeFlowHandler{
+		callbackPath: "/",
+		state:        "STATE",
+		gotCode: func(resp authorizationResponse) {
+			t.Errorf("gotCode wants not to be called after cancelled")
+		},
+		gotError: func(err error) {
+			t.Errorf("gotError wants not to be called after cancelled")
+		},
+	}
+	h.cancel()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?code=AUTH_CODE&state=STATE", nil))
+	if w.Code != 503 {
+		t.Errorf("StatusCode wants 503 but %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Login cancelled") {
+		t.Errorf("body wants the cancellation page but %s", w.Body.String())
+	}
+}
+
+func TestAuthCodeFlowHandler_InvalidResponse(t *testing.T) {
+	for _, target := range []string{
+		"/?code=AUTH_CODE&error=access_denied&state=STATE",
+		"/?code=AUTH_CODE",
+		"/?error=access_denied",
+		"/?code=AUTH_CODE&state=INVALID",
+	} {
+		t.Run(target, func(t *testing.T) {
+			var gotErr error
+			h := &authCodeFlowHandler{
+				callbackPath: "/",
+				state:        "STATE",
+				gotCode: func(resp authorizationResponse) {
+					t.Errorf("gotCode wants not to be called")
+				},
+				gotError: func(err error) {
+					t.Errorf("gotError wants not to be called but %s", err)
+				},
+				gotInvalid: func(err error) {
+					gotErr = err
+				},
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			if w.Code != 400 {
+				t.Errorf("StatusCode wants 400 but %d", w.Code)
+			}
+			if gotErr == nil || !strings.Contains(gotErr.Error(), "Invalid authorization response") {
+				t.Errorf("gotInvalid wants an invalid response error but %v", gotErr)
+			}
+			if h.responded {
+				t.Errorf("responded wants false after an invalid response")
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlowHandler_Fallback(t *testing.T) {
+	var gotCode string
+	h := &authCodeFlowHandler{
+		authCodeURL:  "https://example.com/auth",
+		callbackPath: "/callback",
+		state:        "STATE",
+		fallback: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+			fmt.Fprint(w, "FALLBACK")
+		}),
+		gotCode: func(resp authorizationResponse) {
+			gotCode = resp.Code
+		},
+		gotError: func(err error) {
+			t.Errorf("gotError wants not to be called but %s", err)
+		},
+	}
+	for _, c := range []struct {
+		target   string
+		wantCode int
+	}{
+		{"/", 302},
+		{"/favicon.ico", 204},
+		{"/healthz", 200},
+		{"/callback?code=AUTH_CODE&state=STATE", 200},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.target, nil))
+		if w.Code != c.wantCode {
+			t.Errorf("%s: StatusCode wants %d but %d", c.target, c.wantCode, w.Code)
+		}
+		if c.target == "/healthz" && w.Body.String() != "FALLBACK" {
+			t.Errorf("%s: body wants FALLBACK but %s", c.target, w.Body.String())
+		}
+	}
+	if gotCode != "AUTH_CODE" {
+		t.Errorf("gotCode wants AUTH_CODE but %s", gotCode)
+	}
+}
+
+func TestAuthCodeFlowHandler_RedirectOnlyOnce(t *testing.T) {
+	h := &authCodeFlowHandler{
+		authCodeURL:  "https://example.com/auth",
+		callbackPath: "/callback",
+		state:        "STATE",
+		success:      SuccessResponse{Body: []byte(successHTML)},
+		gotCode:      func(resp authorizationResponse) {},
+		gotError: func(err error) {
+			t.Errorf("gotError wants not to be called but %s", err)
+		},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 302 {
+		t.Errorf("StatusCode wants 302 but %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/callback?code=AUTH_CODE&state=STATE", nil))
+	if w.Code != 200 {
+		t.Errorf("StatusCode wants 200 but %d", w.Code)
+	}
+	// e.g. the user navigates back
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("StatusCode wants 200 but %d", w.Code)
+	}
+	if w.Body.String() != successHTML {
+		t.Errorf("body wants the success page but %s", w.Body.String())
+	}
+}
+
+func TestAuthCodeFlowHandler_CallbackTwice(t *testing.T) {
+	var gotCodeCount int32
+	h := &authCodeFlowHandler{
+		callbackPath: "/",
+		state:        "STATE",
+		success:      SuccessResponse{Body: []byte(successHTML)},
+		gotCode: func(resp authorizationResponse) {
+			atomic.AddInt32(&gotCodeCount, 1)
+		},
+		gotError: func(err error) {
+			t.Errorf("gotError wants not to be called but %s", err)
+		},
+	}
+	var wg sync.WaitGroup
+	bodies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/?code=AUTH_CODE&state=STATE", nil))
+			bodies <- w.Body.String()
+		}()
+	}
+	wg.Wait()
+	close(bodies)
+	if n := atomic.LoadInt32(&gotCodeCount); n != 1 {
+		t.Errorf("gotCode wants to be called once but %d", n)
+	}
+	// e.g. a double click or prefetch while the flow is in flight
+	for body := range bodies {
+		if body != successHTML {
+			t.Errorf("body wants the success page but %s", body)
+		}
+	}
+	// another code is not a duplicate
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?code=ANOTHER_CODE&state=STATE", nil))
+	if body := w.Body.String(); w.Code != 400 || !strings.Contains(body, "already been used") {
+		t.Errorf("response wants 400 and the already used page but %d %s", w.Code, body)
+	}
+}
+
+func TestAuthCodeFlowHandler_ReplayAfterCompletion(t *testing.T) {
+	var gotCodeCount int
+	h := &authCodeFlowHandler{
+		callbackPath: "/callback",
+		state:        "STATE",
+		success:      SuccessResponse{Body: []byte(successHTML)},
+		gotCode: func(resp authorizationResponse) {
+			gotCodeCount++
+		},
+		gotError: func(err error) {
+			t.Errorf("gotError wants not to be called but %s", err)
+		},
+	}
+	const target = "/callback?code=AUTH_CODE&state=STATE"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	if w.Code != 200 {
+		t.Errorf("StatusCode wants 200 but %d", w.Code)
+	}
+
+	// the same callback while the flow is in flight, e.g. a reload
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	if w.Code != 200 || w.Body.String() != successHTML {
+		t.Errorf("in-flight duplicate wants 200 and the success page but %d %s", w.Code, w.Body.String())
+	}
+
+	// replay the exact successful callback after completion, in both of query and form_post
+	h.finish()
+	formPost := httptest.NewRequest("POST", "/callback", strings.NewReader("code=AUTH_CODE&state=STATE"))
+	formPost.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, r := range []*http.Request{httptest.NewRequest("GET", target, nil), formPost} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != 400 {
+			t.Errorf("%s: StatusCode wants 400 but %d", r.Method, w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "already been used") {
+			t.Errorf("%s: body wants the already used page but %s", r.Method, body)
+		}
+	}
+	if gotCodeCount != 1 {
+		t.Errorf("gotCode wants to be called once but %d", gotCodeCount)
+	}
+}
+
+func TestAuthCodeFlowHandler_ParamNames(t *testing.T) {
+	names := ResponseParamNames{Code: "authCode", State: "st", Error: "err", ErrorDescription: "errDesc"}
+	t.Run("Code", func(t *testing.T) {
+		var got authorizationResponse
+		h := &authCodeFlowHandler{
+			callbackPath: "/",
+			state:        "STATE",
+			paramNames:   names,
+			gotCode: func(resp authorizationResponse) {
+				got = resp
+			},
+			gotError: func(err error) {
+				t.Errorf("gotError wants not to be called but %s", err)
+			},
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?authCode=AUTH_CODE&st=STATE", nil))
+		if w.Code != 200 {
+			t.Errorf("StatusCode wants 200 but %d", w.Code)
+		}
+		if got.Code != "AUTH_CODE" || got.State != "STATE" {
+			t.Errorf("response wants AUTH_CODE and STATE but %+v", got)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		var gotErr error
+		h := &authCodeFlowHandler{
+			callbackPath: "/",
+			state:        "STATE",
+			paramNames:   names,
+			gotCode: func(resp authorizationResponse) {
+				t.Errorf("gotCode wants not to be called")
+			},
+			gotError: func(err error) {
+				gotErr = err
+			},
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?err=access_denied&errDesc=DENIED&st=STATE", nil))
+		if w.Code != 500 {
+			t.Errorf("StatusCode wants 500 but %d", w.Code)
+		}
+		if gotErr == nil || !strings.Contains(gotErr.Error(), "access_denied DENIED") {
+			t.Errorf("gotError wants the OAuth error but %v", gotErr)
+		}
+	})
+}
+
+func TestAuthCodeFlow_tlsCertificate_File(t *testing.T) {
+	generated, err := newSelfSignedCertificate()
+	if err != nil {
+		t.Fatalf("Could not generate a certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(generated.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Could not marshal the key: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "oauth2cli")
+	if err != nil {
+		t.Fatalf("Could not create a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: generated.Certificate[0]}), 0600); err != nil {
+		t.Fatalf("Could not write the certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Could not write the key: %s", err)
+	}
+
+	f := &AuthCodeFlow{LocalServerCertFile: certFile, LocalServerKeyFile: keyFile}
+	if !f.useTLS() {
+		t.Errorf("useTLS wants true if LocalServerCertFile is set")
+	}
+	cert, err := f.tlsCertificate()
+	if err != nil {
+		t.Fatalf("Could not load the certificate: %s", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], generated.Certificate[0]) {
+		t.Errorf("certificate wants the one in the file")
+	}
+
+	f.LocalServerKeyFile = filepath.Join(dir, "missing.pem")
+	if _, err := f.tlsCertificate(); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestAuthCodeFlowHandler_ErrorHTML(t *testing.T) {
+	var gotErr error
+	h := &authCodeFlowHandler{
+		callbackPath: "/",
+		state:        "STATE",
+		errorHTML:    `<html><body>Anmeldung fehlgeschlagen</body></html>`,
+		gotCode: func(resp authorizationResponse) {
+			t.Errorf("gotCode wants not to be called on an error response")
+		},
+		gotError: func(err error) { gotErr = err },
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?error=access_denied&state=STATE", nil))
+	if w.Code != 500 {
+		t.Errorf("StatusCode wants 500 but %d", w.Code)
+	}
+	if w.Body.String() != h.errorHTML {
+		t.Errorf("body wants the error page but %s", w.Body.String())
+	}
+	if w, g := "text/html; charset=utf-8", w.Header().Get("Content-Type"); w != g {
+		t.Errorf("Content-Type wants %s but %s", w, g)
+	}
+	if gotErr == nil || !strings.Contains(gotErr.Error(), "access_denied") {
+		t.Errorf("gotError wants access_denied but %v", gotErr)
+	}
+
+	// the replayed response and the cancellation are shown in the same page
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?error=access_denied&state=STATE", nil))
+	if w.Code != 400 || w.Body.String() != h.errorHTML {
+		t.Errorf("replay wants 400 and the error page but %d %s", w.Code, w.Body.String())
+	}
+	h.cancel()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 503 || w.Body.String() != h.errorHTML {
+		t.Errorf("cancelled wants 503 and the error page but %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthCodeFlowHandler_writeTemplate(t *testing.T) {
+	newHandler := func(exchangeErr error) *authCodeFlowHandler {
+		h := &authCodeFlowHandler{
+			success:  SuccessResponse{Body: []byte(successHTML)},
+			status:   newExchangeStatus(),
+			template: template.Must(template.New("").Parse(`{{index .GrantedScopes 5}}`)),
+			logger:   NewJSONLogger(ioutil.Discard),
+		}
+		h.status.complete(&Result{}, exchangeErr)
+		return h
+	}
+	t.Run("ExecutionError", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newHandler(nil).writeTemplate(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != 200 || w.Body.String() != successHTML {
+			t.Errorf("response wants 200 and the success page but %d %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("ExecutionErrorAfterExchangeError", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newHandler(errors.New("invalid_grant")).writeTemplate(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != 500 || !strings.Contains(w.Body.String(), "Login failed") {
+			t.Errorf("response wants 500 and the error page but %d %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("RequestDone", func(t *testing.T) {
+		h := newHandler(nil)
+		h.status = newExchangeStatus()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := httptest.NewRecorder()
+		h.writeTemplate(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if w.Body.Len() == 0 {
+			t.Errorf("body wants non-empty")
+		}
+	})
+}
+
+func TestAuthCodeFlow_listenAndConfigure_RedirectURLHostname(t *testing.T) {
+	f := &AuthCodeFlow{
+		Config: oauth2.Config{
+			Endpoint: oauth2.Endpoint{AuthURL: "https://example.com/auth", TokenURL: "https://example.com/token"},
+		},
+		RedirectURLHostname: "local.example.dev",
+	}
+	listener, config, err := f.listenAndConfigure(context.Background())
+	if err != nil {
+		t.Fatalf("listenAndConfigure error: %s", err)
+	}
+	defer listener.Close()
+	if ip := listener.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("listener wants the loopback address but %s", ip)
+	}
+	if want := fmt.Sprintf("http://local.example.dev:%d", listener.Port); config.RedirectURL != want {
+		t.Errorf("RedirectURL wants %s but %s", want, config.RedirectURL)
+	}
+}
@@ -2,13 +2,33 @@ package oauth2cli_test
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/int128/oauth2cli"
+	"github.com/int128/oauth2cli/oauth2clitest"
 	"golang.org/x/oauth2"
 )
 
@@ -34,6 +54,27 @@ func ExampleAuthCodeFlow() {
     log.Printf("Got a token: %+v", token)
 }
 
+func ExampleAuthCodeFlow_multipleAccounts() {
+	ctx := context.Background()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+			Scopes:       []string{"email"},
+		},
+	}
+	// Each call has its own local server and state, so the flow can be reused.
+	for _, tenant := range []string{"tenant1", "tenant2"} {
+		flow.LoginHint = "user@" + tenant + ".example.com"
+		token, err := flow.GetToken(ctx)
+		if err != nil {
+			log.Fatalf("Could not get a token for %s: %s", tenant, err)
+		}
+		log.Printf("Got a token for %s: %+v", tenant, token)
+	}
+}
+
 func TestAuthCodeFlow_GetToken(t *testing.T) {
 	// Start an auth server.
 	h := authServerHandler{
@@ -91,56 +132,2547 @@ func TestAuthCodeFlow_GetToken(t *testing.T) {
 	}
 }
 
-func openBrowserRequest(url string) error {
-	resp, err := http.Get(url)
+func TestAuthCodeFlow_AuthCodeURL(t *testing.T) {
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+			Scopes:       []string{"email"},
+		},
+		State:     "STATE",
+		LoginHint: "user@example.com",
+	}
+	authURL, err := flow.AuthCodeURL(context.Background())
 	if err != nil {
-		return fmt.Errorf("Could not send a request: %s", err)
+		t.Fatalf("Could not get the URL: %s", err)
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("StatusCode wants 200 but %d", resp.StatusCode)
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Invalid URL: %s", err)
+	}
+	if want := endpoint.AuthURL; u.Scheme+"://"+u.Host+u.Path != want {
+		t.Errorf("URL wants %s but %s", want, authURL)
+	}
+	q := u.Query()
+	if !strings.HasPrefix(q.Get("redirect_uri"), "http://localhost:") {
+		t.Errorf("redirect_uri wants http://localhost:port but %s", q.Get("redirect_uri"))
+	}
+	for key, want := range map[string]string{
+		"client_id":  "YOUR_CLIENT_ID",
+		"scope":      "email",
+		"state":      "STATE",
+		"login_hint": "user@example.com",
+	} {
+		if q.Get(key) != want {
+			t.Errorf("%s wants %s but %s", key, want, q.Get(key))
+		}
 	}
-	return nil
 }
 
-type authServerHandler struct {
-	Scope        string
-	AuthCode     string
-	AccessToken  string
-	RefreshToken string
+func TestAuthCodeFlow_GetToken_InvalidTokenURL(t *testing.T) {
+	for _, tokenURL := range []string{"", "example.com/token", "ftp://example.com/token", "https://", "https://example.com/%zz"} {
+		t.Run(tokenURL, func(t *testing.T) {
+			flow := oauth2cli.AuthCodeFlow{
+				Config: oauth2.Config{
+					ClientID: "YOUR_CLIENT_ID",
+					Endpoint: oauth2.Endpoint{AuthURL: endpoint.AuthURL, TokenURL: tokenURL},
+				},
+				SkipOpenBrowser: true,
+				ShowLocalServerURL: func(url string) {
+					t.Errorf("ShowLocalServerURL must not be called")
+				},
+			}
+			_, err := flow.GetToken(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "TokenURL") {
+				t.Errorf("err wants a TokenURL error but %v", err)
+			}
+			if _, err := flow.Exchange(context.Background(), "AUTH_CODE"); err == nil {
+				t.Errorf("Exchange wants an error but nil")
+			}
+		})
+	}
 }
 
-func (h *authServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := h.serveHTTP(w, r); err != nil {
-		log.Printf("[authServer] Error: %s", err)
-		w.WriteHeader(500)
+func TestAuthCodeFlow_AuthCodeURL_MalformedScopes(t *testing.T) {
+	var messages []oauth2cli.LogMessage
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: endpoint,
+			Scopes:   []string{"openid", "email profile", "offline_access,groups"},
+		},
+		Logger: loggerFunc(func(m oauth2cli.LogMessage) {
+			messages = append(messages, m)
+		}),
+	}
+	if _, err := flow.AuthCodeURL(context.Background()); err != nil {
+		t.Fatalf("Could not get the URL: %s", err)
+	}
+	var scopes []string
+	for _, m := range messages {
+		if m.Event == "scope_malformed" {
+			scopes = append(scopes, m.Fields["scope"])
+		}
+	}
+	if want := []string{"email profile", "offline_access,groups"}; !reflect.DeepEqual(want, scopes) {
+		t.Errorf("scope_malformed wants %v but %v", want, scopes)
 	}
 }
 
-func (h *authServerHandler) serveHTTP(w http.ResponseWriter, r *http.Request) error {
-	switch {
-	case r.Method == "GET" && r.URL.Path == "/auth":
-		q := r.URL.Query()
-		if h.Scope != q.Get("scope") {
-			return fmt.Errorf("scope wants %s but %s", h.Scope, q.Get("scope"))
+func TestAuthCodeFlow_AuthCodeURL_RedirectURLMismatch(t *testing.T) {
+	port := findFreePort(t)
+	for _, redirectURL := range []string{
+		fmt.Sprintf("http://localhost:%d", port+1),
+		fmt.Sprintf("https://localhost:%d", port),
+		fmt.Sprintf("http://example.com:%d", port),
+	} {
+		t.Run(redirectURL, func(t *testing.T) {
+			var messages []oauth2cli.LogMessage
+			flow := oauth2cli.AuthCodeFlow{
+				Config: oauth2.Config{
+					ClientID:    "YOUR_CLIENT_ID",
+					Endpoint:    endpoint,
+					RedirectURL: redirectURL,
+				},
+				LocalServerPort: port,
+				Logger: loggerFunc(func(m oauth2cli.LogMessage) {
+					messages = append(messages, m)
+				}),
+			}
+			if _, err := flow.AuthCodeURL(context.Background()); err != nil {
+				t.Fatalf("Could not get the URL: %s", err)
+			}
+			if len(messages) != 1 || messages[0].Event != "redirect_url_mismatch" {
+				t.Errorf("messages wants a redirect_url_mismatch but %+v", messages)
+			}
+
+			flow.StrictRedirectCheck = true
+			if _, err := flow.AuthCodeURL(context.Background()); err == nil {
+				t.Errorf("err wants non-nil but nil")
+			}
+		})
+	}
+	t.Run("Loopback", func(t *testing.T) {
+		flow := oauth2cli.AuthCodeFlow{
+			Config: oauth2.Config{
+				ClientID:    "YOUR_CLIENT_ID",
+				Endpoint:    endpoint,
+				RedirectURL: fmt.Sprintf("http://127.0.0.1:%d/callback", port),
+			},
+			LocalServerPort:     port,
+			StrictRedirectCheck: true,
 		}
-		to := fmt.Sprintf("%s?state=%s&code=%s", q.Get("redirect_uri"), q.Get("state"), h.AuthCode)
-		http.Redirect(w, r, to, 302)
+		if _, err := flow.AuthCodeURL(context.Background()); err != nil {
+			t.Errorf("Could not get the URL: %s", err)
+		}
+	})
+}
 
-	case r.Method == "POST" && r.URL.Path == "/token":
-		if err := r.ParseForm(); err != nil {
-			return fmt.Errorf("Could not parse form: %s", err)
+func TestAuthCodeFlow_Start(t *testing.T) {
+	h := authServerHandler{
+		Scope:        "email",
+		AuthCode:     "AUTH_CODE",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  s.URL + "/auth",
+				TokenURL: s.URL + "/token",
+			},
+			Scopes: []string{"email"},
+		},
+		ShowLocalServerURL: func(url string) {
+			t.Errorf("ShowLocalServerURL must not be called")
+		},
+	}
+	t.Run("Success", func(t *testing.T) {
+		authURL, result, cancel, err := flow.Start(ctx)
+		if err != nil {
+			t.Fatalf("Could not start the flow: %s", err)
 		}
-		if h.AuthCode != r.Form.Get("code") {
-			return fmt.Errorf("code wants %s but %s", h.AuthCode, r.Form.Get("code"))
+		defer cancel()
+		if !strings.HasPrefix(authURL, s.URL+"/auth?") {
+			t.Errorf("authURL wants the authorization URL but %s", authURL)
 		}
-		w.Header().Add("Content-Type", "application/json")
-		b := fmt.Sprintf(`{
-			"access_token": "%s",
-			"token_type": "Bearer",
-			"expires_in": 3600,
-			"refresh_token": "%s"
-		}`, h.AccessToken, h.RefreshToken)
-		if _, err := w.Write([]byte(b)); err != nil {
+		if err := openBrowserRequest(authURL); err != nil {
+			t.Fatalf("Could not open browser request: %s", err)
+		}
+		r := <-result
+		if r.Err != nil {
+			t.Fatalf("Could not get a token: %s", r.Err)
+		}
+		if r.Token.AccessToken != "ACCESS_TOKEN" {
+			t.Errorf("AccessToken wants %s but %s", "ACCESS_TOKEN", r.Token.AccessToken)
+		}
+		if _, ok := <-result; ok {
+			t.Errorf("result wants to be closed")
+		}
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		_, result, cancel, err := flow.Start(ctx)
+		if err != nil {
+			t.Fatalf("Could not start the flow: %s", err)
+		}
+		cancel()
+		r := <-result
+		for _, want := range []error{oauth2cli.ErrCancelled, oauth2cli.ErrUserCancelled, context.Canceled} {
+			if !errors.Is(r.Err, want) {
+				t.Errorf("err wants %v but %v", want, r.Err)
+			}
+		}
+	})
+	t.Run("CancelOnCodeReceived", func(t *testing.T) {
+		cancelCh := make(chan func(), 1)
+		flow := flow
+		flow.OnCodeReceived = func() { (<-cancelCh)() }
+		authURL, result, cancel, err := flow.Start(ctx)
+		if err != nil {
+			t.Fatalf("Could not start the flow: %s", err)
+		}
+		cancelCh <- cancel
+		go func() {
+			openBrowserRequest(authURL)
+		}()
+		r := <-result
+		for _, want := range []error{oauth2cli.ErrCancelled, oauth2cli.ErrUserCancelled, context.Canceled} {
+			if !errors.Is(r.Err, want) {
+				t.Errorf("err wants %v but %v", want, r.Err)
+			}
+		}
+	})
+}
+
+func TestAuthCodeFlow_Exchange(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  s.URL + "/auth",
+				TokenURL: s.URL + "/token",
+			},
+			RedirectURL: "http://localhost:8000",
+		},
+	}
+	token, err := flow.Exchange(context.Background(), "AUTH_CODE")
+	if err != nil {
+		t.Fatalf("Could not exchange token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants %s but %s", "ACCESS_TOKEN", token.AccessToken)
+	}
+	if token.RefreshToken != "REFRESH_TOKEN" {
+		t.Errorf("RefreshToken wants %s but %s", "REFRESH_TOKEN", token.RefreshToken)
+	}
+	if _, err := flow.Exchange(context.Background(), "INVALID_CODE"); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+	if _, err := flow.Exchange(context.Background(), ""); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestAuthCodeFlow_Exchange_RequireIDToken(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		extraJSON string
+	}{
+		{"Missing", ""},
+		{"Empty", `, "id_token": ""`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:       "AUTH_CODE",
+				AccessToken:    "ACCESS_TOKEN",
+				TokenExtraJSON: c.extraJSON,
+			}
+			s := httptest.NewServer(&h)
+			defer s.Close()
+			flow := oauth2cli.AuthCodeFlow{
+				Config: oauth2.Config{
+					ClientID:     "YOUR_CLIENT_ID",
+					ClientSecret: "YOUR_CLIENT_SECRET",
+					Endpoint: oauth2.Endpoint{
+						AuthURL:  s.URL + "/auth",
+						TokenURL: s.URL + "/token",
+					},
+					RedirectURL: "http://localhost:8000",
+				},
+				RequireIDToken: true,
+			}
+			_, err := flow.Exchange(context.Background(), "AUTH_CODE")
+			if !errors.Is(err, oauth2cli.ErrMissingIDToken) {
+				t.Errorf("err wants ErrMissingIDToken but %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_NoCallbackActivity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+		},
+		SkipOpenBrowser:           true,
+		ShowLocalServerURL:        func(url string) {},
+		NoCallbackActivityTimeout: 100 * time.Millisecond,
+	}
+	_, err := flow.GetToken(ctx)
+	if !errors.Is(err, oauth2cli.ErrNoCallbackActivity) {
+		t.Errorf("err wants ErrNoCallbackActivity but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_NoCallbackActivity_OpenAuthURLDirectly(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+		},
+		SkipOpenBrowser:           true,
+		ShowLocalServerURL:        func(url string) {},
+		OpenAuthURLDirectly:       true,
+		NoCallbackActivityTimeout: 100 * time.Millisecond,
+	}
+	// the user may be still logging in on the provider
+	_, err := flow.GetToken(ctx)
+	if errors.Is(err, oauth2cli.ErrNoCallbackActivity) {
+		t.Errorf("err wants not ErrNoCallbackActivity but %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_BeforeOpenBrowser(t *testing.T) {
+	h := &authServerHandler{
+		Scope:       "email profile",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	t.Run("Confirmed", func(t *testing.T) {
+		var authURL string
+		token, err := getTokenWithAuthServer(t, h, oauth2cli.AuthCodeFlow{
+			BeforeOpenBrowser: func(u string) error {
+				authURL = u
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("Could not get a token: %s", err)
+		}
+		if token.AccessToken != "ACCESS_TOKEN" {
+			t.Errorf("AccessToken wants %s but %s", "ACCESS_TOKEN", token.AccessToken)
+		}
+		if !strings.Contains(authURL, "/auth?") {
+			t.Errorf("authURL wants the authorization URL but %s", authURL)
+		}
+	})
+	t.Run("Declined", func(t *testing.T) {
+		declined := errors.New("declined")
+		_, err := getTokenWithAuthServer(t, h, oauth2cli.AuthCodeFlow{
+			BeforeOpenBrowser: func(string) error { return declined },
+			ShowLocalServerURL: func(url string) {
+				t.Errorf("ShowLocalServerURL must not be called")
+			},
+		})
+		if !errors.Is(err, declined) {
+			t.Errorf("err wants %v but %v", declined, err)
+		}
+		if n := h.TokenRequests(); n != 1 {
+			t.Errorf("token requests wants 1 (only Confirmed) but %d", n)
+		}
+	})
+}
+
+func TestAuthCodeFlow_GetToken_Timeout(t *testing.T) {
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+		},
+		SkipOpenBrowser:    true,
+		ShowLocalServerURL: func(url string) {},
+		Timeout:            100 * time.Millisecond,
+	}
+	_, err := flow.GetToken(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but %v", err)
+	}
+	if !errors.Is(err, oauth2cli.ErrFlowTimeout) {
+		t.Errorf("err wants ErrFlowTimeout but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Timeout_TokenRequest(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+		TokenDelay:  time.Second,
+	}
+	flow := oauth2cli.AuthCodeFlow{Timeout: 300 * time.Millisecond}
+	_, err := getTokenWithAuthServer(t, &h, flow)
+	if !errors.Is(err, oauth2cli.ErrFlowTimeout) {
+		t.Errorf("err wants ErrFlowTimeout but %v", err)
+	}
+	var exchangeErr *oauth2cli.ExchangeError
+	if !errors.As(err, &exchangeErr) {
+		t.Errorf("err wants ExchangeError but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_OpenAuthURLDirectly(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	token, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+		OpenAuthURLDirectly: true,
+		ShowLocalServerURL: func(url string) {
+			if !strings.Contains(url, "/auth?") {
+				t.Errorf("url wants the authorization URL but %s", url)
+			}
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants %s but %s", "ACCESS_TOKEN", token.AccessToken)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_StartupDelay(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	started := time.Now()
+	var shown time.Time
+	_, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+		StartupDelay: 200 * time.Millisecond,
+		ShowLocalServerURL: func(url string) {
+			shown = time.Now()
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if d := shown.Sub(started); d < 200*time.Millisecond {
+		t.Errorf("ShowLocalServerURL wants to be called after the delay but %s", d)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_LocalServerReadHeaderTimeout(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	_, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+		LocalServerReadHeaderTimeout: 100 * time.Millisecond,
+		ShowLocalServerURL: func(localServerURL string) {
+			// A connection which sends nothing must be closed by the server.
+			u, err := url.Parse(localServerURL)
+			if err != nil {
+				t.Errorf("Invalid URL: %s", err)
+				return
+			}
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				t.Errorf("Could not connect: %s", err)
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("Read wants io.EOF but %v", err)
+			}
+			if err := openBrowserRequest(localServerURL); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+		},
+		SkipOpenBrowser:    true,
+		ShowLocalServerURL: func(url string) { cancel() },
+	}
+	_, err := flow.GetToken(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err wants context.Canceled but %v", err)
+	}
+	if !errors.Is(err, oauth2cli.ErrUserCancelled) {
+		t.Errorf("err wants ErrUserCancelled but %v", err)
+	}
+	if errors.Is(err, oauth2cli.ErrFlowTimeout) {
+		t.Errorf("err wants not ErrFlowTimeout but %v", err)
+	}
+	if errors.Is(err, oauth2cli.ErrCancelled) {
+		t.Errorf("err wants not ErrCancelled but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_StateMismatch(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		thenLogin bool
+	}{
+		{name: "Timeout"},
+		{name: "ThenLogin", thenLogin: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				Scope:       "email",
+				AuthCode:    "AUTH_CODE",
+				AccessToken: "ACCESS_TOKEN",
+			}
+			var rejected int32
+			token, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+				Timeout: 1 * time.Second,
+				Logger: loggerFunc(func(m oauth2cli.LogMessage) {
+					if m.Event == "authorization_response_rejected" {
+						atomic.AddInt32(&rejected, 1)
+					}
+				}),
+				ShowLocalServerURL: func(url string) {
+					// e.g. a callback of the previous flow, or from another process
+					if err := openBrowserRequest(url + "/?code=AUTH_CODE&state=INVALID"); err == nil {
+						t.Errorf("err wants non-nil but nil")
+					}
+					if !c.thenLogin {
+						return
+					}
+					if err := openBrowserRequest(url); err != nil {
+						t.Errorf("Could not open browser request: %s", err)
+					}
+				},
+			})
+			if n := atomic.LoadInt32(&rejected); n != 1 {
+				t.Errorf("rejected wants 1 but %d", n)
+			}
+			if c.thenLogin {
+				if err != nil {
+					t.Fatalf("Could not get a token: %s", err)
+				}
+				if token.AccessToken != "ACCESS_TOKEN" {
+					t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+				}
+				return
+			}
+			if !errors.Is(err, oauth2cli.ErrStateMismatch) {
+				t.Errorf("err wants ErrStateMismatch but %v", err)
+			}
+			if !errors.Is(err, oauth2cli.ErrFlowTimeout) {
+				t.Errorf("err wants ErrFlowTimeout but %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_TLS(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  s.URL + "/auth",
+				TokenURL: s.URL + "/token",
+			},
+			Scopes: []string{"email"},
+		},
+		SkipOpenBrowser: true,
+		UseTLS:          true,
+		ShowLocalServerURL: func(url string) {
+			if !strings.HasPrefix(url, "https://localhost:") {
+				t.Errorf("url wants https://localhost:port but %s", url)
+			}
+			if err := openBrowserRequestWithClient(client, url); err != nil {
+				cancel()
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	token, err := flow.GetToken(ctx)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if h.AccessToken != token.AccessToken {
+		t.Errorf("AccessToken wants %s but %s", h.AccessToken, token.AccessToken)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_RequestParams(t *testing.T) {
+	resources := []string{"https://a.example.com", "https://b.example.com"}
+	for _, c := range []struct {
+		name    string
+		handler *authServerHandler // AuthCode, Scope, AccessToken and RefreshToken are set in the test
+		flow    oauth2cli.AuthCodeFlow
+	}{
+		{
+			name:    "ForceLogin",
+			handler: &authServerHandler{Prompt: "login"},
+			flow:    oauth2cli.AuthCodeFlow{ForceLogin: true},
+		},
+		{
+			name:    "PromptAndLoginHint",
+			handler: &authServerHandler{Prompt: "consent login", LoginHint: "user@example.com"},
+			flow:    oauth2cli.AuthCodeFlow{Prompt: "consent", LoginHint: "user@example.com", ForceLogin: true},
+		},
+		{
+			name:    "Audience",
+			handler: &authServerHandler{Audience: "https://api.example.com"},
+			flow:    oauth2cli.AuthCodeFlow{Audience: "https://api.example.com"},
+		},
+		{
+			name:    "Resources",
+			handler: &authServerHandler{Resources: resources},
+			flow:    oauth2cli.AuthCodeFlow{Resources: resources},
+		},
+		{
+			name: "TokenRequestParams",
+			handler: &authServerHandler{
+				GrantType:   "urn:example:authorization_code",
+				TokenParams: url.Values{"tenant": {"TENANT"}},
+			},
+			flow: oauth2cli.AuthCodeFlow{
+				GrantType: "urn:example:authorization_code",
+				TokenRequestParams: url.Values{
+					"tenant": {"TENANT"},
+					"code":   {"OVERRIDDEN"}, // must be ignored
+				},
+			},
+		},
+		{
+			name:    "State",
+			handler: &authServerHandler{State: "STATE_FROM_CALLER"},
+			flow:    oauth2cli.AuthCodeFlow{State: "STATE_FROM_CALLER"},
+		},
+		{
+			name:    "StateGenerator",
+			handler: &authServerHandler{State: "GENERATED_STATE"},
+			flow: oauth2cli.AuthCodeFlow{
+				StateGenerator: func() (string, error) { return "GENERATED_STATE", nil },
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := c.handler
+			h.AuthCode, h.Scope, h.AccessToken, h.RefreshToken = "AUTH_CODE", "email", "ACCESS_TOKEN", "REFRESH_TOKEN"
+			token, err := getTokenWithAuthServer(t, h, c.flow)
+			if err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			if h.AccessToken != token.AccessToken {
+				t.Errorf("AccessToken wants %s but %s", h.AccessToken, token.AccessToken)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_InvalidSettings(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		flow oauth2cli.AuthCodeFlow
+	}{
+		{
+			name: "EmptyStateGenerator",
+			flow: oauth2cli.AuthCodeFlow{
+				StateGenerator: func() (string, error) { return "", nil },
+			},
+		},
+		{
+			name: "LocalServerCallbackPathWithoutLeadingSlash",
+			flow: oauth2cli.AuthCodeFlow{LocalServerCallbackPath: "oauth/callback"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:    "AUTH_CODE",
+				Scope:       "email",
+				AccessToken: "ACCESS_TOKEN",
+			}
+			flow := c.flow
+			flow.ShowLocalServerURL = func(url string) {
+				t.Errorf("ShowLocalServerURL must not be called")
+			}
+			if _, err := getTokenWithAuthServer(t, &h, flow); err == nil {
+				t.Errorf("err wants non-nil but nil")
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_HTTPClient(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	transport := &countTransport{}
+	flow := oauth2cli.AuthCodeFlow{
+		HTTPClient: &http.Client{Transport: transport},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if transport.Count() != 1 {
+		t.Errorf("token requests via HTTPClient wants 1 but %d", transport.Count())
+	}
+}
+
+func TestAuthCodeFlow_GetToken_TokenRequestTimeout(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+		TokenDelay:   500 * time.Millisecond,
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		TokenRequestTimeout: 50 * time.Millisecond,
+	}
+	_, err := getTokenWithAuthServer(t, &h, flow)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_SaveState(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	t.Run("Saved", func(t *testing.T) {
+		var saved string
+		flow := oauth2cli.AuthCodeFlow{
+			StateGenerator: func() (string, error) {
+				return "GENERATED_STATE", nil
+			},
+			SaveState: func(state string) error {
+				saved = state
+				return nil
+			},
+		}
+		if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+			t.Fatalf("Could not get a token: %s", err)
+		}
+		if saved != "GENERATED_STATE" {
+			t.Errorf("saved state wants GENERATED_STATE but %s", saved)
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		saveErr := errors.New("disk full")
+		flow := oauth2cli.AuthCodeFlow{
+			SaveState: func(string) error { return saveErr },
+			ShowLocalServerURL: func(url string) {
+				t.Errorf("ShowLocalServerURL must not be called")
+			},
+		}
+		if _, err := getTokenWithAuthServer(t, &h, flow); !errors.Is(err, saveErr) {
+			t.Errorf("err wants %v but %v", saveErr, err)
+		}
+	})
+}
+
+func TestAuthCodeFlow_GetToken_Favicon(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		ShowLocalServerURL: func(url string) {
+			resp, err := http.Get(url + "/favicon.ico")
+			if err != nil {
+				t.Errorf("Could not send a request: %s", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 204 {
+				t.Errorf("StatusCode wants 204 but %d", resp.StatusCode)
+			}
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_FormPost(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		AuthCodeOptions: []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("response_mode", "form_post"),
+		},
+		ShowLocalServerURL: func(localServerURL string) {
+			if err := openFormPostBrowserRequest(localServerURL, url.Values{"code": {h.AuthCode}}); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	token, err := getTokenWithAuthServer(t, &h, flow)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if h.AccessToken != token.AccessToken {
+		t.Errorf("AccessToken wants %s but %s", h.AccessToken, token.AccessToken)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_HybridFlow(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "openid",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"USER","nonce":"NONCE"}`))
+	idToken := "eyJhbGciOiJub25lIn0." + payload + ".SIGNATURE"
+	flow := oauth2cli.AuthCodeFlow{
+		ResponseType: "code id_token",
+		Nonce:        "NONCE",
+		ShowLocalServerURL: func(localServerURL string) {
+			form := url.Values{"code": {h.AuthCode}, "id_token": {idToken}}
+			if err := openFormPostBrowserRequest(localServerURL, form); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	r, err := getTokenResultWithAuthServer(t, &h, flow)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if r.Token.AccessToken != h.AccessToken {
+		t.Errorf("AccessToken wants %s but %s", h.AccessToken, r.Token.AccessToken)
+	}
+	if r.IDToken != idToken {
+		t.Errorf("IDToken wants %s but %s", idToken, r.IDToken)
+	}
+	if r.IDTokenClaims["sub"] != "USER" {
+		t.Errorf("IDTokenClaims wants sub=USER but %v", r.IDTokenClaims)
+	}
+}
+
+func TestAuthCodeFlow_AuthCodeURL_ResponseType(t *testing.T) {
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: endpoint,
+		},
+		ResponseType: "code id_token",
+	}
+	authURL, err := flow.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get the URL: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Invalid URL: %s", err)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code id_token" {
+		t.Errorf("response_type wants code id_token but %s", q.Get("response_type"))
+	}
+	if q.Get("response_mode") != "form_post" {
+		t.Errorf("response_mode wants form_post but %s", q.Get("response_mode"))
+	}
+}
+
+func TestAuthCodeFlow_GetToken_CallbackAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     endpoint,
+		},
+		SkipOpenBrowser: true,
+		ShowLocalServerURL: func(url string) {
+			cancel()
+			// The server may be already closed, so ignore the error.
+			resp, err := http.Get(url + "/?code=AUTH_CODE&state=INVALID")
+			if err == nil {
+				resp.Body.Close()
+			}
+		},
+	}
+	if _, err := flow.GetToken(ctx); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Concurrent(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  s.URL + "/auth",
+				TokenURL: s.URL + "/token",
+			},
+			Scopes: []string{"email"},
+		},
+		SkipOpenBrowser: true,
+		ShowLocalServerURL: func(url string) {
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := flow.GetToken(ctx); err != nil {
+				t.Errorf("Could not get a token: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if flow.Config.RedirectURL != "" {
+		t.Errorf("Config.RedirectURL wants empty but %s", flow.Config.RedirectURL)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Repeated(t *testing.T) {
+	s := oauth2clitest.NewServer(oauth2clitest.Provider{})
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     s.Endpoint,
+		},
+		SkipOpenBrowser:    true,
+		ShowLocalServerURL: oauth2clitest.Browser(t),
+	}
+	var states []string
+	for i := 0; i < 2; i++ {
+		if _, err := flow.GetToken(ctx); err != nil {
+			t.Fatalf("Could not get a token: %s", err)
+		}
+		states = append(states, s.State())
+	}
+	if flow.Config.RedirectURL != "" {
+		t.Errorf("Config.RedirectURL wants empty but %s", flow.Config.RedirectURL)
+	}
+	if states[0] == states[1] {
+		t.Errorf("state wants to differ but both %s", states[0])
+	}
+}
+
+// openFormPostBrowserRequest simulates a browser which receives an authorization response in form_post mode.
+// It follows the redirect to the auth server and then posts the code to the redirect URI.
+// The form is sent with the state parameter of the authorization request.
+func openFormPostBrowserRequest(localServerURL string, form url.Values) error {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(localServerURL)
+	if err != nil {
+		return fmt.Errorf("Could not send a request: %s", err)
+	}
+	resp.Body.Close()
+	authURL, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("Could not get the redirect location: %s", err)
+	}
+	q := authURL.Query()
+	if q.Get("response_mode") != "form_post" {
+		return fmt.Errorf("response_mode wants form_post but %s", q.Get("response_mode"))
+	}
+	v := url.Values{"state": {q.Get("state")}}
+	for key, values := range form {
+		v[key] = values
+	}
+	resp, err = http.PostForm(q.Get("redirect_uri"), v)
+	if err != nil {
+		return fmt.Errorf("Could not send a request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("StatusCode wants 200 but %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func TestAuthCodeFlow_GetToken_OnCodeReceived(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	transport := &countTransport{}
+	var tokenRequestsOnCodeReceived []int
+	flow := oauth2cli.AuthCodeFlow{
+		HTTPClient: &http.Client{Transport: transport},
+		OnCodeReceived: func() {
+			tokenRequestsOnCodeReceived = append(tokenRequestsOnCodeReceived, transport.Count())
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if len(tokenRequestsOnCodeReceived) != 1 {
+		t.Fatalf("OnCodeReceived wants to be called once but %d", len(tokenRequestsOnCodeReceived))
+	}
+	if tokenRequestsOnCodeReceived[0] != 0 {
+		t.Errorf("OnCodeReceived wants to be called before the token request")
+	}
+}
+
+func TestAuthCodeFlow_GetToken_RedirectURLHostname(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	port := findFreePort(t)
+	var localServerURL string
+	flow := oauth2cli.AuthCodeFlow{
+		LocalServerPort:     port,
+		RedirectURLHostname: "127.0.0.1",
+		ShowLocalServerURL: func(url string) {
+			localServerURL = url
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	want := fmt.Sprintf("http://127.0.0.1:%d", port)
+	if localServerURL != want {
+		t.Errorf("local server URL wants %s but %s", want, localServerURL)
+	}
+	if !h.redirectURIs[want] {
+		t.Errorf("redirect_uri wants %s but %v", want, h.redirectURIs)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_LocalServerCallbackPath(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	port := findFreePort(t)
+	localServerURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)}
+	proxy := httptest.NewServer(http.StripPrefix("/oauth", httputil.NewSingleHostReverseProxy(localServerURL)))
+	defer proxy.Close()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			RedirectURL: proxy.URL + "/oauth/callback",
+		},
+		LocalServerPort:         port,
+		LocalServerCallbackPath: "/callback",
+		// the redirect URL points to the proxy, and it should not be checked
+		StrictRedirectCheck: true,
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if want := proxy.URL + "/oauth/callback"; !h.redirectURIs[want] {
+		t.Errorf("redirect_uri wants %s but %v", want, h.redirectURIs)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_RedirectURL(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		callbackPath string // LocalServerCallbackPath
+		redirectPath string // path of Config.RedirectURL. Not set if empty
+		wantPath     string // path of redirect_uri
+	}{
+		{name: "LocalServerCallbackPath", callbackPath: "/oauth/callback", wantPath: "/oauth/callback"},
+		{name: "RedirectURL/Root", redirectPath: "/", wantPath: "/"},
+		{name: "RedirectURL/Callback", redirectPath: "/callback", wantPath: "/callback"},
+		{name: "RedirectURL/TrailingSlash", redirectPath: "/callback/", wantPath: "/callback/"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:    "AUTH_CODE",
+				Scope:       "email",
+				AccessToken: "ACCESS_TOKEN",
+			}
+			port := findFreePort(t)
+			flow := oauth2cli.AuthCodeFlow{
+				LocalServerPort:         port,
+				LocalServerCallbackPath: c.callbackPath,
+			}
+			if c.redirectPath != "" {
+				flow.Config.RedirectURL = fmt.Sprintf("http://localhost:%d%s", port, c.redirectPath)
+			}
+			if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			if want := fmt.Sprintf("http://localhost:%d%s", port, c.wantPath); !h.redirectURIs[want] {
+				t.Errorf("redirect_uri wants %s but %v", want, h.redirectURIs)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_ErrorOnCallbackPath(t *testing.T) {
+	h := authServerHandler{
+		Scope: "email",
+		Error: "access_denied",
+	}
+	port := findFreePort(t)
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			RedirectURL: fmt.Sprintf("http://localhost:%d/callback", port),
+		},
+		LocalServerPort: port,
+		ShowLocalServerURL: func(url string) {
+			// The local server responds an error, so ignore it.
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+		},
+	}
+	_, err := getTokenWithAuthServer(t, &h, flow)
+	if err == nil {
+		t.Fatalf("err wants non-nil but nil")
+	}
+	if !strings.Contains(err.Error(), "access_denied") {
+		t.Errorf("err wants the provider error but %s", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_LocalServerPorts(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+	freePort := findFreePort(t)
+
+	var localServerURL string
+	_, err = getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+		LocalServerPorts: []int{busyPort, freePort},
+		ShowLocalServerURL: func(url string) {
+			localServerURL = url
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if want := fmt.Sprintf("http://localhost:%d", freePort); localServerURL != want {
+		t.Errorf("local server URL wants %s but %s", want, localServerURL)
+	}
+
+	_, err = getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{LocalServerPort: busyPort})
+	if !errors.Is(err, oauth2cli.ErrPortInUse) {
+		t.Errorf("err wants ErrPortInUse but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_LocalServerPorts_Concurrent(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	const n = 3
+	ports := []int{findFreePort(t), findFreePort(t), findFreePort(t)}
+	// all flows hold the port until every flow has started the local server
+	var started int32
+	allStarted := make(chan struct{})
+	// closed if any flow failed, so that the others do not wait forever
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	urls := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{
+				LocalServerPorts: ports,
+				ShowLocalServerURL: func(url string) {
+					urls <- url
+					if atomic.AddInt32(&started, 1) == n {
+						close(allStarted)
+					}
+					select {
+					case <-allStarted:
+					case <-failed:
+						return
+					case <-time.After(3 * time.Second):
+						t.Errorf("Timed out waiting for the other flows to start")
+						return
+					}
+					if err := openBrowserRequest(url); err != nil {
+						t.Errorf("Could not open browser request: %s", err)
+					}
+				},
+			})
+			if err != nil {
+				failOnce.Do(func() { close(failed) })
+				t.Errorf("Could not get a token: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(urls)
+	seen := make(map[string]bool)
+	for url := range urls {
+		if seen[url] {
+			t.Errorf("local server URL %s is used by multiple flows", url)
+		}
+		seen[url] = true
+	}
+	if len(seen) != n {
+		t.Errorf("local server URLs wants %d distinct URLs but %v", n, seen)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Middleware(t *testing.T) {
+	h := authServerHandler{
+		Scope:       "email",
+		AuthCode:    "AUTH_CODE",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	var mu sync.Mutex
+	var paths []string
+	flow := oauth2cli.AuthCodeFlow{
+		Middleware: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				if r.URL.Path == "/blocked" {
+					http.Error(w, "Forbidden", 403)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		},
+		ShowLocalServerURL: func(url string) {
+			if err := openBrowserRequest(url + "/blocked"); err == nil {
+				t.Errorf("err wants non-nil but nil")
+			}
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/blocked", "/", "/"}; !reflect.DeepEqual(want, paths) {
+		t.Errorf("paths wants %v but %v", want, paths)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Listener(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	flow := oauth2cli.AuthCodeFlow{
+		Listener: l,
+		ShowLocalServerURL: func(url string) {
+			if want := fmt.Sprintf("http://localhost:%d", port); url != want {
+				t.Errorf("url wants %s but %s", want, url)
+			}
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+func TestAuthCodeFlow_AuthCodeURL_Listener(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: oauth2.Endpoint{AuthURL: "https://example.com/auth", TokenURL: "https://example.com/token"},
+		},
+		Listener: l,
+	}
+	u, err := flow.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get the URL: %s", err)
+	}
+	if want := url.QueryEscape(fmt.Sprintf("http://localhost:%d", port)); !strings.Contains(u, "redirect_uri="+want) {
+		t.Errorf("URL wants redirect_uri=%s but %s", want, u)
+	}
+	// the listener should be left open for the flow
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_UnixListener(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	dir, err := ioutil.TempDir("", "oauth2cli")
+	if err != nil {
+		t.Fatalf("Could not create a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "callback.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Could not listen on a Unix domain socket: %s", err)
+	}
+	// The browser forwards requests for the redirect URL to the socket.
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr == "callback.example.com:80" {
+					return net.Dial("unix", socket)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		Config:   oauth2.Config{RedirectURL: "http://callback.example.com/"},
+		Listener: l,
+		ShowLocalServerURL: func(url string) {
+			if err := openBrowserRequestWithClient(client, url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+// findFreePort returns a port which is not used at the moment.
+func findFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestAuthCodeFlow_GetToken_WWWAuthenticate(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:         "AUTH_CODE",
+		Scope:            "email",
+		TokenErrorStatus: 401,
+		TokenErrorHeader: http.Header{"WWW-Authenticate": {`Basic realm="example"`}},
+	}
+	_, err := getTokenWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{})
+	if err == nil {
+		t.Fatalf("err wants non-nil but nil")
+	}
+	if !strings.Contains(err.Error(), `WWW-Authenticate: Basic realm="example"`) {
+		t.Errorf("err wants WWW-Authenticate but %s", err)
+	}
+	var rErr *oauth2.RetrieveError
+	if !errors.As(err, &rErr) {
+		t.Errorf("err wants *oauth2.RetrieveError but %T", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_TokenResponse(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		handler *authServerHandler // AuthCode, Scope, AccessToken and RefreshToken are set in the test
+		check   func(t *testing.T, token *oauth2.Token)
+	}{
+		{
+			name:    "ExtraFields",
+			handler: &authServerHandler{TokenExtraJSON: `, "resource_server": "https://api.example.com"`},
+			check: func(t *testing.T, token *oauth2.Token) {
+				if v := token.Extra("resource_server"); v != "https://api.example.com" {
+					t.Errorf("resource_server wants https://api.example.com but %v", v)
+				}
+			},
+		},
+		{
+			name:    "TokenType",
+			handler: &authServerHandler{TokenType: "bearer"},
+			check: func(t *testing.T, token *oauth2.Token) {
+				if token.TokenType != "Bearer" {
+					t.Errorf("TokenType wants Bearer but %s", token.TokenType)
+				}
+				if v := token.Extra("token_type"); v != "bearer" {
+					t.Errorf("token_type wants bearer but %v", v)
+				}
+			},
+		},
+		{
+			name:    "AcceptJSON",
+			handler: &authServerHandler{TokenResponseFormUnlessAcceptJSON: true},
+			check: func(t *testing.T, token *oauth2.Token) {
+				// expires_in is a number in JSON.
+				if _, ok := token.Extra("expires_in").(float64); !ok {
+					t.Errorf("expires_in wants a number of JSON but %T", token.Extra("expires_in"))
+				}
+			},
+		},
+		{
+			name:    "FormEncoded",
+			handler: &authServerHandler{TokenResponseForm: true},
+			check: func(t *testing.T, token *oauth2.Token) {
+				if token.RefreshToken != "REFRESH_TOKEN" {
+					t.Errorf("RefreshToken wants REFRESH_TOKEN but %s", token.RefreshToken)
+				}
+				if token.Expiry.IsZero() {
+					t.Errorf("Expiry wants non-zero")
+				}
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := c.handler
+			h.AuthCode, h.Scope, h.AccessToken, h.RefreshToken = "AUTH_CODE", "email", "ACCESS_TOKEN", "REFRESH_TOKEN"
+			token, err := getTokenWithAuthServer(t, h, oauth2cli.AuthCodeFlow{})
+			if err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			if h.AccessToken != token.AccessToken {
+				t.Errorf("AccessToken wants %s but %s", h.AccessToken, token.AccessToken)
+			}
+			c.check(t, token)
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Retry(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:         "AUTH_CODE",
+		Scope:            "email",
+		AccessToken:      "ACCESS_TOKEN",
+		RefreshToken:     "REFRESH_TOKEN",
+		TokenErrorStatus: 503,
+		TokenErrorTimes:  2,
+		TokenErrorHeader: http.Header{"Retry-After": {"0"}},
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		TokenRequestMaxAttempts:  3,
+		TokenRequestRetryBackoff: 10 * time.Millisecond,
+	}
+	token, err := getTokenWithAuthServer(t, &h, flow)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if h.AccessToken != token.AccessToken {
+		t.Errorf("AccessToken wants %s but %s", h.AccessToken, token.AccessToken)
+	}
+	if h.TokenRequests() != 3 {
+		t.Errorf("token requests wants 3 but %d", h.TokenRequests())
+	}
+}
+
+func TestAuthCodeFlow_GetToken_NoRetryOnOAuthError(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:         "AUTH_CODE",
+		Scope:            "email",
+		TokenErrorStatus: 400,
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		TokenRequestMaxAttempts:  3,
+		TokenRequestRetryBackoff: 10 * time.Millisecond,
+		// do not detect the style by the error
+		AuthStyle: oauth2cli.AuthStyleInHeader,
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err == nil {
+		t.Fatalf("err wants non-nil but nil")
+	}
+	if h.TokenRequests() != 1 {
+		t.Errorf("token requests wants 1 but %d", h.TokenRequests())
+	}
+}
+
+// countTransport counts the requests sent via the transport.
+type countTransport struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.count++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (c *countTransport) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func TestAuthCodeFlow_GetToken_EventHandler(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	eventCh := make(chan oauth2cli.Event, 16)
+	flow := oauth2cli.AuthCodeFlow{
+		ShowLocalServerURL: func(url string) {
+			// Open the browser after the flow started waiting.
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				if err := openBrowserRequest(url); err != nil {
+					t.Errorf("Could not open browser request: %s", err)
+				}
+			}()
+		},
+		EventHandler: func(e oauth2cli.Event) {
+			time.Sleep(10 * time.Millisecond) // slow handler
+			eventCh <- e
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	want := []oauth2cli.EventType{
+		oauth2cli.EventServerStarted,
+		oauth2cli.EventBrowserOpened,
+		oauth2cli.EventWaiting,
+		oauth2cli.EventCodeReceived,
+		oauth2cli.EventExchanging,
+		oauth2cli.EventDone,
+	}
+	for _, w := range want {
+		select {
+		case e := <-eventCh:
+			if e.Type != w {
+				t.Errorf("event wants %s but %s", w, e.Type)
+			}
+			if e.Time.IsZero() {
+				t.Errorf("Time of %s wants non-zero", e.Type)
+			}
+			if e.Type == oauth2cli.EventDone && e.Err != nil {
+				t.Errorf("Err of %s wants nil but %s", e.Type, e.Err)
+			}
+			if e.Type == oauth2cli.EventServerStarted || e.Type == oauth2cli.EventBrowserOpened {
+				if !strings.Contains(e.AuthURL, "/auth?") || !strings.Contains(e.AuthURL, "state=") {
+					t.Errorf("AuthURL of %s wants the authorization URL but %s", e.Type, e.AuthURL)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", w)
+		}
+	}
+}
+
+type recordMetrics struct {
+	authorizations []time.Duration
+	exchanges      []time.Duration
+}
+
+func (m *recordMetrics) ObserveAuthorization(d time.Duration, err error) {
+	m.authorizations = append(m.authorizations, d)
+}
+
+func (m *recordMetrics) ObserveTokenExchange(d time.Duration, err error) {
+	m.exchanges = append(m.exchanges, d)
+}
+
+func TestAuthCodeFlow_GetToken_Metrics(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+		TokenDelay:   100 * time.Millisecond,
+	}
+	var m recordMetrics
+	flow := oauth2cli.AuthCodeFlow{Metrics: &m}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if len(m.authorizations) != 1 {
+		t.Errorf("authorizations wants 1 but %d", len(m.authorizations))
+	}
+	if len(m.exchanges) != 1 {
+		t.Fatalf("exchanges wants 1 but %d", len(m.exchanges))
+	}
+	if m.exchanges[0] < h.TokenDelay {
+		t.Errorf("exchange duration wants >= %s but %s", h.TokenDelay, m.exchanges[0])
+	}
+}
+
+func TestAuthCodeFlow_GetTokenResult(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"USER","nonce":"NONCE"}`))
+	idToken := "eyJhbGciOiJub25lIn0." + payload + ".SIGNATURE"
+	h := authServerHandler{
+		AuthCode:       "AUTH_CODE",
+		Scope:          "email openid",
+		State:          "STATE",
+		AccessToken:    "ACCESS_TOKEN",
+		RefreshToken:   "REFRESH_TOKEN",
+		TokenExtraJSON: fmt.Sprintf(`, "scope": "email", "id_token": %q`, idToken),
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  s.URL + "/auth",
+				TokenURL: s.URL + "/token",
+			},
+			Scopes: []string{"email", "openid"},
+		},
+		State:           "STATE",
+		Nonce:           "NONCE",
+		SkipOpenBrowser: true,
+		ShowLocalServerURL: func(url string) {
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	before := time.Now()
+	r, err := flow.GetTokenResult(ctx)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if r.Token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants %s but %s", "ACCESS_TOKEN", r.Token.AccessToken)
+	}
+	if r.ObtainedAt.Before(before) || r.ObtainedAt.After(time.Now()) {
+		t.Errorf("ObtainedAt wants the time of the token response but %s", r.ObtainedAt)
+	}
+	if expiresIn, _ := r.Raw["expires_in"].(float64); !r.Token.Expiry.Equal(r.ObtainedAt.Add(time.Duration(expiresIn) * time.Second)) {
+		t.Errorf("Expiry wants ObtainedAt + %v seconds but %s", expiresIn, r.Token.Expiry)
+	}
+	if want := []string{"email"}; !reflect.DeepEqual(want, r.GrantedScopes) {
+		t.Errorf("GrantedScopes wants %v but %v", want, r.GrantedScopes)
+	}
+	if r.State != "STATE" {
+		t.Errorf("State wants STATE but %s", r.State)
+	}
+	if r.Raw["access_token"] != "ACCESS_TOKEN" {
+		t.Errorf("Raw wants access_token but %v", r.Raw)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(r.RawBody, &body); err != nil || body.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("RawBody wants the token response but %s", r.RawBody)
+	}
+	if r.IDToken != idToken {
+		t.Errorf("IDToken wants %s but %s", idToken, r.IDToken)
+	}
+	if r.IDTokenClaims["sub"] != "USER" {
+		t.Errorf("IDTokenClaims wants sub=USER but %v", r.IDTokenClaims)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_EmptyIDToken(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:       "AUTH_CODE",
+		Scope:          "email",
+		AccessToken:    "ACCESS_TOKEN",
+		RefreshToken:   "REFRESH_TOKEN",
+		TokenExtraJSON: `, "id_token": ""`,
+	}
+	r, err := getTokenResultWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{})
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if r.IDToken != "" {
+		t.Errorf("IDToken wants empty but %s", r.IDToken)
+	}
+	if v := r.Token.Extra("id_token"); v != nil {
+		t.Errorf("Extra(id_token) wants nil but %v", v)
+	}
+
+	_, err = getTokenResultWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{RequireIDToken: true})
+	if !errors.Is(err, oauth2cli.ErrMissingIDToken) {
+		t.Errorf("err wants ErrMissingIDToken but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_Nonce(t *testing.T) {
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: oauth2.Endpoint{AuthURL: "https://example.com/auth", TokenURL: "https://example.com/token"},
+			Scopes:   []string{"openid"},
+		},
+	}
+	u, err := flow.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("AuthCodeURL error: %s", err)
+	}
+	authURL, err := url.Parse(u)
+	if err != nil {
+		t.Fatalf("Invalid URL: %s", err)
+	}
+	if authURL.Query().Get("nonce") == "" {
+		t.Errorf("nonce wants to be generated but %s", u)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"USER","nonce":"ANOTHER"}`))
+	h := authServerHandler{
+		AuthCode:       "AUTH_CODE",
+		Scope:          "openid",
+		AccessToken:    "ACCESS_TOKEN",
+		RefreshToken:   "REFRESH_TOKEN",
+		TokenExtraJSON: fmt.Sprintf(`, "id_token": %q`, "eyJhbGciOiJub25lIn0."+payload+".SIGNATURE"),
+	}
+	_, err = getTokenResultWithAuthServer(t, &h, oauth2cli.AuthCodeFlow{Nonce: "NONCE"})
+	if !errors.Is(err, oauth2cli.ErrInvalidIDToken) {
+		t.Errorf("err wants ErrInvalidIDToken but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_ClientAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+		TokenParams: url.Values{
+			"client_id":             {"YOUR_CLIENT_ID"},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_secret":         nil,
+		},
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		ClientAssertion: &oauth2cli.ClientAssertion{Key: key},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_SkipAutoClose(t *testing.T) {
+	for _, c := range []struct {
+		skipAutoClose bool
+		wantScript    bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		t.Run(fmt.Sprintf("SkipAutoClose=%v", c.skipAutoClose), func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:     "AUTH_CODE",
+				Scope:        "email",
+				AccessToken:  "ACCESS_TOKEN",
+				RefreshToken: "REFRESH_TOKEN",
+			}
+			bodyCh := make(chan string, 1)
+			flow := oauth2cli.AuthCodeFlow{
+				SkipAutoClose: c.skipAutoClose,
+				ShowLocalServerURL: func(url string) {
+					body, err := openBrowserRequestBody(http.DefaultClient, url)
+					if err != nil {
+						t.Errorf("Could not open browser request: %s", err)
+					}
+					bodyCh <- body
+				},
+			}
+			if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			body := <-bodyCh
+			if !strings.Contains(body, "return to the terminal") {
+				t.Errorf("body wants the message but %s", body)
+			}
+			if got := strings.Contains(body, "window.close()"); got != c.wantScript {
+				t.Errorf("window.close() in body wants %v but %v", c.wantScript, got)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_SuccessResponse(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:     "AUTH_CODE",
+		Scope:        "email",
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	}
+	respCh := make(chan *http.Response, 1)
+	flow := oauth2cli.AuthCodeFlow{
+		SuccessResponse: &oauth2cli.SuccessResponse{
+			StatusCode:  202,
+			ContentType: "application/json",
+			Body:        []byte(`{"status":"ok"}`),
+		},
+		ShowLocalServerURL: func(url string) {
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Errorf("Could not send a request: %s", err)
+				close(respCh)
+				return
+			}
+			respCh <- resp
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	resp := <-respCh
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read the body: %s", err)
+	}
+	if resp.StatusCode != 202 {
+		t.Errorf("StatusCode wants 202 but %d", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Content-Type"); v != "application/json" {
+		t.Errorf("Content-Type wants application/json but %s", v)
+	}
+	if string(b) != `{"status":"ok"}` {
+		t.Errorf("body wants the JSON but %s", b)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_WaitForTokenExchange(t *testing.T) {
+	for _, c := range []struct {
+		name             string
+		tokenErrorStatus int
+		wantStatus       string
+	}{
+		{"Success", 0, `{"status":"ok"}`},
+		{"TokenError", 400, `{"status":"error"}`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:         "AUTH_CODE",
+				Scope:            "email",
+				AccessToken:      "ACCESS_TOKEN",
+				TokenErrorStatus: c.tokenErrorStatus,
+			}
+			statusCh := make(chan string, 1)
+			flow := oauth2cli.AuthCodeFlow{
+				WaitForTokenExchange: true,
+				ShowLocalServerURL: func(url string) {
+					defer close(statusCh)
+					body, err := openBrowserRequestBody(http.DefaultClient, url)
+					if err != nil {
+						t.Errorf("Could not open browser request: %s", err)
+						return
+					}
+					if !strings.Contains(body, `fetch("/status")`) {
+						t.Errorf("body wants the script to fetch the status but %s", body)
+					}
+					// the browser fetches the status by the script
+					status, err := openBrowserRequestBody(http.DefaultClient, url+"/status")
+					if err != nil {
+						t.Errorf("Could not get the status: %s", err)
+						return
+					}
+					statusCh <- status
+				},
+			}
+			_, err := getTokenWithAuthServer(t, &h, flow)
+			if c.tokenErrorStatus == 0 && err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			if c.tokenErrorStatus != 0 && err == nil {
+				t.Fatalf("err wants non-nil but nil")
+			}
+			if status := <-statusCh; status != c.wantStatus {
+				t.Errorf("status wants %s but %s", c.wantStatus, status)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_WaitForTokenExchange_CallbackPath(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	statusCh := make(chan string, 1)
+	flow := oauth2cli.AuthCodeFlow{
+		WaitForTokenExchange:    true,
+		LocalServerCallbackPath: "/oauth/callback",
+		ShowLocalServerURL: func(url string) {
+			defer close(statusCh)
+			body, err := openBrowserRequestBody(http.DefaultClient, url)
+			if err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+				return
+			}
+			// e.g. the user navigates back to the root
+			revisited, err := openBrowserRequestBody(http.DefaultClient, url)
+			if err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+				return
+			}
+			for _, page := range []string{body, revisited} {
+				if !strings.Contains(page, `fetch("/oauth/status")`) {
+					t.Errorf("page wants to fetch /oauth/status but %s", page)
+				}
+			}
+			status, err := openBrowserRequestBody(http.DefaultClient, url+"/oauth/status")
+			if err != nil {
+				t.Errorf("Could not get the status: %s", err)
+				return
+			}
+			statusCh <- status
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if w, g := `{"status":"ok"}`, <-statusCh; w != g {
+		t.Errorf("status wants %s but %s", w, g)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_WaitForTokenExchange_WriteTimeout(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+		TokenDelay:  300 * time.Millisecond,
+	}
+	statusCh := make(chan string, 1)
+	flow := oauth2cli.AuthCodeFlow{
+		WaitForTokenExchange:    true,
+		LocalServerWriteTimeout: 100 * time.Millisecond,
+		ShowLocalServerURL: func(url string) {
+			defer close(statusCh)
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+				return
+			}
+			// the status is responded after the token exchange, which takes longer than the write timeout
+			status, err := openBrowserRequestBody(http.DefaultClient, url+"/status")
+			if err != nil {
+				t.Errorf("Could not get the status: %s", err)
+				return
+			}
+			statusCh <- status
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if w, g := `{"status":"ok"}`, <-statusCh; w != g {
+		t.Errorf("status wants %s but %s", w, g)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_WaitForTokenExchange_SuccessResponse(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	flow := oauth2cli.AuthCodeFlow{
+		WaitForTokenExchange: true,
+		SuccessResponse:      &oauth2cli.SuccessResponse{Body: []byte("<html>OK</html>")},
+		ShutdownTimeout:      3 * time.Second,
+	}
+	// the page does not fetch the status, so the flow should not wait for it
+	start := time.Now()
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if d := time.Since(start); d >= flow.ShutdownTimeout {
+		t.Errorf("GetToken wants to return before ShutdownTimeout but took %s", d)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_SuccessTemplate(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"email":"user@example.com"}`))
+	idToken := "eyJhbGciOiJub25lIn0." + payload + ".SIGNATURE"
+	for _, c := range []struct {
+		name     string
+		template string
+		wantBody string
+		wantLog  bool
+	}{
+		{
+			name:     "Executed",
+			template: `Logged in as {{.IDTokenClaims.email}} with {{range .GrantedScopes}}{{.}}{{end}}`,
+			wantBody: "Logged in as user@example.com with email",
+		},
+		{
+			name:     "ExecutionError",
+			template: `{{index .GrantedScopes 5}}`,
+			wantBody: "return to the terminal",
+			wantLog:  true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:       "AUTH_CODE",
+				Scope:          "email",
+				AccessToken:    "ACCESS_TOKEN",
+				TokenExtraJSON: fmt.Sprintf(`, "scope": "email", "id_token": %q`, idToken),
+			}
+			bodyCh := make(chan string, 1)
+			var messages []oauth2cli.LogMessage
+			var mu sync.Mutex
+			flow := oauth2cli.AuthCodeFlow{
+				SuccessTemplate: template.Must(template.New("").Parse(c.template)),
+				Logger: loggerFunc(func(m oauth2cli.LogMessage) {
+					mu.Lock()
+					defer mu.Unlock()
+					messages = append(messages, m)
+				}),
+				ShowLocalServerURL: func(url string) {
+					body, err := openBrowserRequestBody(http.DefaultClient, url)
+					if err != nil {
+						t.Errorf("Could not open browser request: %s", err)
+					}
+					bodyCh <- body
+				},
+			}
+			if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+				t.Fatalf("Could not get a token: %s", err)
+			}
+			if body := <-bodyCh; !strings.Contains(body, c.wantBody) {
+				t.Errorf("body wants %q but %s", c.wantBody, body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			var gotLog bool
+			for _, m := range messages {
+				if m.Event == "success_template_failed" {
+					gotLog = true
+				}
+			}
+			if gotLog != c.wantLog {
+				t.Errorf("success_template_failed wants %v but %v", c.wantLog, gotLog)
+			}
+		})
+	}
+}
+
+func TestAuthCodeFlow_GetToken_AuditLog(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:    "AUTH_CODE",
+		Scope:       "email",
+		AccessToken: "ACCESS_TOKEN",
+	}
+	type auditEntry struct {
+		method, path string
+		accepted     bool
+	}
+	var mu sync.Mutex
+	var entries []auditEntry
+	flow := oauth2cli.AuthCodeFlow{
+		AuditLog: func(method, path, remoteAddr string, accepted bool) {
+			if remoteAddr == "" {
+				t.Errorf("remoteAddr wants non-empty")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, auditEntry{method, path, accepted})
+		},
+		ShowLocalServerURL: func(url string) {
+			// probe by something other than the browser
+			if resp, err := http.Get(url + "/probe"); err == nil {
+				resp.Body.Close()
+			}
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	if _, err := getTokenWithAuthServer(t, &h, flow); err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []auditEntry{
+		{"GET", "/probe", false},
+		{"GET", "/", true},
+		{"GET", "/", true}, // callback
+	}
+	if !reflect.DeepEqual(want, entries) {
+		t.Errorf("entries wants %+v but %+v", want, entries)
+	}
+}
+
+func TestAuthCodeFlow_GetToken_ExchangeError(t *testing.T) {
+	h := authServerHandler{
+		AuthCode:         "AUTH_CODE",
+		Scope:            "email",
+		AccessToken:      "ACCESS_TOKEN",
+		TokenErrorStatus: 503,
+		TokenErrorTimes:  1,
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: oauth2.Endpoint{AuthURL: s.URL + "/auth", TokenURL: s.URL + "/token"},
+			Scopes:   []string{"email"},
+		},
+		SkipOpenBrowser: true,
+		ShowLocalServerURL: func(url string) {
+			if err := openBrowserRequest(url); err != nil {
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		},
+	}
+	_, err := flow.GetToken(ctx)
+	var exchangeErr *oauth2cli.ExchangeError
+	if !errors.As(err, &exchangeErr) {
+		t.Fatalf("err wants ExchangeError but %v", err)
+	}
+	if exchangeErr.Code != "AUTH_CODE" {
+		t.Errorf("Code wants AUTH_CODE but %s", exchangeErr.Code)
+	}
+	if strings.Contains(err.Error(), "AUTH_CODE") {
+		t.Errorf("error message must not contain the code: %s", err)
+	}
+
+	// retry the token request without the browser interaction
+	flow.Config.RedirectURL = exchangeErr.RedirectURL
+	token, err := flow.Exchange(ctx, exchangeErr.Code)
+	if err != nil {
+		t.Fatalf("Could not exchange token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+}
+
+// getTokenWithAuthServer runs the flow against the auth server and a browser request.
+// Config and the browser related fields of the flow are set by this function.
+// ShowLocalServerURL is set to open a browser request only if it is nil.
+func getTokenWithAuthServer(t *testing.T, h *authServerHandler, flow oauth2cli.AuthCodeFlow) (*oauth2.Token, error) {
+	r, err := getTokenResultWithAuthServer(t, h, flow)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// getTokenResultWithAuthServer is same as getTokenWithAuthServer but returns the result.
+func getTokenResultWithAuthServer(t *testing.T, h *authServerHandler, flow oauth2cli.AuthCodeFlow) (*oauth2cli.Result, error) {
+	s := httptest.NewServer(h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow.Config.ClientID = "YOUR_CLIENT_ID"
+	flow.Config.ClientSecret = "YOUR_CLIENT_SECRET"
+	flow.Config.Endpoint = oauth2.Endpoint{
+		AuthURL:  s.URL + "/auth",
+		TokenURL: s.URL + "/token",
+	}
+	flow.Config.Scopes = []string{h.Scope}
+	flow.SkipOpenBrowser = true
+	if flow.ShowLocalServerURL == nil {
+		flow.ShowLocalServerURL = func(url string) {
+			if err := openBrowserRequest(url); err != nil {
+				cancel()
+				t.Errorf("Could not open browser request: %s", err)
+			}
+		}
+	}
+	return flow.GetTokenResult(ctx)
+}
+
+func openBrowserRequest(url string) error {
+	return openBrowserRequestWithClient(http.DefaultClient, url)
+}
+
+func openBrowserRequestWithClient(client *http.Client, url string) error {
+	_, err := openBrowserRequestBody(client, url)
+	return err
+}
+
+func openBrowserRequestBody(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("Could not send a request: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("StatusCode wants 200 but %d", resp.StatusCode)
+	}
+	return string(b), nil
+}
+
+type authServerHandler struct {
+	Scope        string
+	Prompt       string
+	LoginHint    string
+	Audience     string   // audience parameter of the authorization request and token request.
+	Resources    []string // resource parameters of the authorization request and token request.
+	State        string   // If set, the state parameter must be this value.
+	AuthCode     string
+	AccessToken  string
+	RefreshToken string
+	TokenDelay   time.Duration // Delay of the token response.
+	Error        string        // If set, the authorization response has this error instead of the code.
+
+	TokenErrorStatus int         // If set, the token response has this status code and no body.
+	TokenErrorTimes  int         // If set, the token error response is returned only for the first n requests.
+	TokenErrorHeader http.Header // Headers of the token error response.
+	TokenExtraJSON   string      // Additional members of the token response, e.g. `, "foo": "bar"`.
+	TokenType        string      // Default to Bearer.
+	GrantType        string      // grant_type of the token request. Default to authorization_code.
+	TokenParams      url.Values  // If set, the token request must have these parameters.
+	TokenErrors      []string    // If set, the token response has these error codes in order with 400, e.g. authorization_pending.
+	ExpiresIn        int         // expires_in of the token response. Default to 3600.
+
+	TokenResponseForm                 bool // If true, the token response is form-encoded.
+	TokenResponseFormUnlessAcceptJSON bool // If true, the token response is form-encoded unless the request accepts JSON.
+
+	DeviceCode string              // If set, the device authorization endpoint returns this code.
+	UserCode   string              // User code of the device authorization response.
+	JWKS       []map[string]string // If set, the JWKS endpoint returns these keys. Lock mu to replace them.
+
+	mu               sync.Mutex
+	tokenRequests    int
+	redirectURIs     map[string]bool // redirect_uri of the authorization requests.
+	receivedRequests []receivedRequest
+}
+
+// receivedRequest represents a request received by authServerHandler.
+type receivedRequest struct {
+	Path       string
+	Form       url.Values
+	BasicAuth  string // client ID and secret in the Authorization header, e.g. YOUR_CLIENT_ID:YOUR_CLIENT_SECRET.
+	ReceivedAt time.Time
+}
+
+// ReceivedRequests returns the requests received on the path.
+func (h *authServerHandler) ReceivedRequests(path string) []receivedRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var requests []receivedRequest
+	for _, r := range h.receivedRequests {
+		if r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (h *authServerHandler) expiresIn() int {
+	if h.ExpiresIn == 0 {
+		return 3600
+	}
+	return h.ExpiresIn
+}
+
+func (h *authServerHandler) tokenType() string {
+	if h.TokenType == "" {
+		return "Bearer"
+	}
+	return h.TokenType
+}
+
+func (h *authServerHandler) grantType() string {
+	if h.GrantType == "" {
+		return "authorization_code"
+	}
+	return h.GrantType
+}
+
+// TokenRequests returns the number of token requests received.
+func (h *authServerHandler) TokenRequests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tokenRequests
+}
+
+func (h *authServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.receive(r); err != nil {
+		log.Printf("[authServer] Error: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	if err := h.serveHTTP(w, r); err != nil {
+		log.Printf("[authServer] Error: %s", err)
+		w.WriteHeader(500)
+	}
+}
+
+func (h *authServerHandler) receive(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("Could not parse form: %s", err)
+	}
+	received := receivedRequest{Path: r.URL.Path, Form: r.Form, ReceivedAt: time.Now()}
+	if id, secret, ok := r.BasicAuth(); ok {
+		received.BasicAuth = id + ":" + secret
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.receivedRequests = append(h.receivedRequests, received)
+	return nil
+}
+
+func (h *authServerHandler) serveHTTP(w http.ResponseWriter, r *http.Request) error {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/auth":
+		q := r.URL.Query()
+		if h.Scope != q.Get("scope") {
+			return fmt.Errorf("scope wants %s but %s", h.Scope, q.Get("scope"))
+		}
+		if h.State != "" && h.State != q.Get("state") {
+			return fmt.Errorf("state wants %s but %s", h.State, q.Get("state"))
+		}
+		if h.Prompt != q.Get("prompt") {
+			return fmt.Errorf("prompt wants %s but %s", h.Prompt, q.Get("prompt"))
+		}
+		if h.LoginHint != q.Get("login_hint") {
+			return fmt.Errorf("login_hint wants %s but %s", h.LoginHint, q.Get("login_hint"))
+		}
+		if h.Audience != q.Get("audience") {
+			return fmt.Errorf("audience wants %s but %s", h.Audience, q.Get("audience"))
+		}
+		if !reflect.DeepEqual(h.Resources, q["resource"]) {
+			return fmt.Errorf("resource wants %v but %v", h.Resources, q["resource"])
+		}
+		h.mu.Lock()
+		if h.redirectURIs == nil {
+			h.redirectURIs = make(map[string]bool)
+		}
+		h.redirectURIs[q.Get("redirect_uri")] = true
+		h.mu.Unlock()
+		to := fmt.Sprintf("%s?state=%s&code=%s", q.Get("redirect_uri"), q.Get("state"), h.AuthCode)
+		if h.Error != "" {
+			to = fmt.Sprintf("%s?state=%s&error=%s", q.Get("redirect_uri"), q.Get("state"), h.Error)
+		}
+		http.Redirect(w, r, to, 302)
+
+	case r.Method == "POST" && r.URL.Path == "/token":
+		time.Sleep(h.TokenDelay)
+		h.mu.Lock()
+		h.tokenRequests++
+		tokenRequests := h.tokenRequests
+		redirectURIs := h.redirectURIs
+		h.mu.Unlock()
+		if h.TokenErrorStatus != 0 && (h.TokenErrorTimes == 0 || tokenRequests <= h.TokenErrorTimes) {
+			for k, v := range h.TokenErrorHeader {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(h.TokenErrorStatus)
+			return nil
+		}
+		if err := r.ParseForm(); err != nil {
+			return fmt.Errorf("Could not parse form: %s", err)
+		}
+		if h.AuthCode != r.Form.Get("code") {
+			return fmt.Errorf("code wants %s but %s", h.AuthCode, r.Form.Get("code"))
+		}
+		if grantType := h.grantType(); grantType != r.Form.Get("grant_type") {
+			return fmt.Errorf("grant_type wants %s but %s", grantType, r.Form.Get("grant_type"))
+		}
+		for key, values := range h.TokenParams {
+			if !reflect.DeepEqual(values, r.Form[key]) {
+				return fmt.Errorf("%s wants %v but %v", key, values, r.Form[key])
+			}
+		}
+		// The redirect_uri must be identical to the authorization request, if it is received.
+		// See https://tools.ietf.org/html/rfc6749#section-4.1.3
+		if redirectURIs != nil && !redirectURIs[r.Form.Get("redirect_uri")] {
+			return fmt.Errorf("redirect_uri wants one of %v but %s", redirectURIs, r.Form.Get("redirect_uri"))
+		}
+		if h.Audience != r.Form.Get("audience") {
+			return fmt.Errorf("audience wants %s but %s", h.Audience, r.Form.Get("audience"))
+		}
+		if !reflect.DeepEqual(h.Resources, r.Form["resource"]) {
+			return fmt.Errorf("resource wants %v but %v", h.Resources, r.Form["resource"])
+		}
+		if tokenRequests <= len(h.TokenErrors) {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, `{"error": "%s"}`, h.TokenErrors[tokenRequests-1])
+			return nil
+		}
+		if h.TokenResponseForm || (h.TokenResponseFormUnlessAcceptJSON && r.Header.Get("Accept") != "application/json") {
+			w.Header().Add("Content-Type", "application/x-www-form-urlencoded")
+			v := url.Values{
+				"access_token":  {h.AccessToken},
+				"token_type":    {h.tokenType()},
+				"expires_in":    {fmt.Sprint(h.expiresIn())},
+				"refresh_token": {h.RefreshToken},
+			}
+			if _, err := w.Write([]byte(v.Encode())); err != nil {
+				return fmt.Errorf("Could not write body: %s", err)
+			}
+			return nil
+		}
+		w.Header().Add("Content-Type", "application/json")
+		b := fmt.Sprintf(`{
+			"access_token": "%s",
+			"token_type": "%s",
+			"expires_in": %d,
+			"refresh_token": "%s"%s
+		}`, h.AccessToken, h.tokenType(), h.expiresIn(), h.RefreshToken, h.TokenExtraJSON)
+		if _, err := w.Write([]byte(b)); err != nil {
+			return fmt.Errorf("Could not write body: %s", err)
+		}
+
+	case r.Method == "POST" && r.URL.Path == "/device" && h.DeviceCode != "":
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"device_code": "%s",
+			"user_code": "%s",
+			"verification_url": "https://example.com/device",
+			"expires_in": 600
+		}`, h.DeviceCode, h.UserCode)
+
+	case r.Method == "GET" && r.URL.Path == "/jwks":
+		h.mu.Lock()
+		keys := h.JWKS
+		h.mu.Unlock()
+		if keys == nil {
+			http.Error(w, "Not Found", 404)
+			return nil
+		}
+		b, err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil {
+			return fmt.Errorf("Could not encode the JWKS: %s", err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(b); err != nil {
 			return fmt.Errorf("Could not write body: %s", err)
 		}
 
@@ -0,0 +1,41 @@
+package oauth2cli
+
+import (
+	"os"
+	"runtime"
+)
+
+// BrowserMode represents whether to open the browser.
+type BrowserMode int
+
+const (
+	// BrowserAuto opens the browser unless the environment looks headless,
+	// i.e. neither DISPLAY nor WAYLAND_DISPLAY is set on Linux, or SSH_CONNECTION is set.
+	BrowserAuto BrowserMode = iota
+	// BrowserAlways opens the browser even if the environment looks headless.
+	BrowserAlways
+	// BrowserNever does not open the browser. The user needs to open the URL manually.
+	BrowserNever
+)
+
+// shouldOpen returns true if the browser should be opened in the environment.
+func (m BrowserMode) shouldOpen() bool {
+	switch m {
+	case BrowserAlways:
+		return true
+	case BrowserNever:
+		return false
+	}
+	return !isHeadless(runtime.GOOS, os.Getenv)
+}
+
+// isHeadless returns true if the environment does not seem to have a browser.
+func isHeadless(goos string, getenv func(string) string) bool {
+	if getenv("SSH_CONNECTION") != "" {
+		return true
+	}
+	if goos == "linux" && getenv("DISPLAY") == "" && getenv("WAYLAND_DISPLAY") == "" {
+		return true
+	}
+	return false
+}
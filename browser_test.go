@@ -0,0 +1,27 @@
+package oauth2cli
+
+import "testing"
+
+func TestIsHeadless(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		goos string
+		env  map[string]string
+		want bool
+	}{
+		{"Linux/X11", "linux", map[string]string{"DISPLAY": ":0"}, false},
+		{"Linux/Wayland", "linux", map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, false},
+		{"Linux/NoDisplay", "linux", map[string]string{}, true},
+		{"Linux/SSH", "linux", map[string]string{"DISPLAY": "localhost:10.0", "SSH_CONNECTION": "192.0.2.1 50000 192.0.2.2 22"}, true},
+		{"Darwin", "darwin", map[string]string{}, false},
+		{"Darwin/SSH", "darwin", map[string]string{"SSH_CONNECTION": "192.0.2.1 50000 192.0.2.2 22"}, true},
+		{"Windows", "windows", map[string]string{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := isHeadless(c.goos, func(key string) string { return c.env[key] })
+			if got != c.want {
+				t.Errorf("isHeadless wants %v but %v", c.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package oauth2cli
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// clientAssertionType is the client_assertion_type of private_key_jwt.
+// See https://tools.ietf.org/html/rfc7523#section-2.2
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+const defaultClientAssertionLifetime = 5 * time.Minute
+
+// ClientAssertion authenticates the client by a JWT signed with the private key, i.e. private_key_jwt,
+// instead of the client secret.
+// See https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type ClientAssertion struct {
+	// Private key to sign the JWT, e.g. *rsa.PrivateKey or a signer backed by HSM or KMS.
+	// The public key must be RSA (RS256) or ECDSA of P-256 (ES256).
+	Key crypto.Signer
+	// Key ID of the JWT header, which the provider uses to find the public key. Default to none.
+	KeyID string
+	// Lifetime of the JWT. Default to 5 minutes.
+	Lifetime time.Duration
+}
+
+// setClientAssertion sets the client assertion and client_id to the form of the token request.
+func setClientAssertion(v url.Values, a *ClientAssertion, config *oauth2.Config) error {
+	assertion, err := a.sign(config.ClientID, config.Endpoint.TokenURL, nowFunc())
+	if err != nil {
+		return fmt.Errorf("Could not create the client assertion: %w", err)
+	}
+	v.Set("client_id", config.ClientID)
+	v.Set("client_assertion_type", clientAssertionType)
+	v.Set("client_assertion", assertion)
+	return nil
+}
+
+// sign returns a JWT with the claims for the token endpoint.
+// Both of iss and sub are the client ID, and aud is the token endpoint.
+func (a *ClientAssertion) sign(clientID, audience string, now time.Time) (string, error) {
+	if a.Key == nil {
+		return "", errors.New("ClientAssertion.Key is required")
+	}
+	// The algorithm is determined by the public key, so that a signer in HSM or KMS can be used.
+	var alg string
+	switch k := a.Key.Public().(type) {
+	case *rsa.PublicKey:
+		alg = "RS256"
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize != 256 {
+			return "", fmt.Errorf("ECDSA key of the client assertion must be P-256 but %s", k.Curve.Params().Name)
+		}
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("Unsupported key type of the client assertion: %T", k)
+	}
+	jti, err := newOAuth2State()
+	if err != nil {
+		return "", fmt.Errorf("Could not generate jti: %w", err)
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if a.KeyID != "" {
+		header["kid"] = a.KeyID
+	}
+	claims := map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": now.Add(durationOrDefault(a.Lifetime, defaultClientAssertionLifetime)).Unix(),
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := a.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("Could not sign the client assertion: %w", err)
+	}
+	if alg == "ES256" {
+		// JWS requires the raw form of r || s instead of ASN.1 DER.
+		// See https://tools.ietf.org/html/rfc7518#section-3.4
+		if sig, err = ecdsaDERToRaw(sig); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ecdsaDERToRaw converts the ASN.1 DER signature of P-256 to the fixed size of r || s.
+func ecdsaDERToRaw(der []byte) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("Invalid ECDSA signature: %w", err)
+	}
+	raw := make([]byte, 64)
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	copy(raw[32-len(r):32], r)
+	copy(raw[64-len(s):], s)
+	return raw, nil
+}
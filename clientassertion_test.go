@@ -0,0 +1,120 @@
+package oauth2cli
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientAssertion_Sign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	verifyRSA := func(digest, sig []byte) bool {
+		return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, sig) == nil
+	}
+	verifyEC := func(digest, sig []byte) bool {
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return len(sig) == 64 && ecdsa.Verify(&ecKey.PublicKey, digest, r, s)
+	}
+	for _, c := range []struct {
+		name   string
+		alg    string
+		key    crypto.Signer
+		verify func(digest, sig []byte) bool
+	}{
+		{"RS256", "RS256", rsaKey, verifyRSA},
+		{"ES256", "ES256", ecKey, verifyEC},
+		// e.g. a key in HSM or KMS
+		{"RS256/Signer", "RS256", opaqueSigner{rsaKey}, verifyRSA},
+		{"ES256/Signer", "ES256", opaqueSigner{ecKey}, verifyEC},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := &ClientAssertion{Key: c.key, KeyID: "KEY_ID"}
+			jwt, err := a.sign("YOUR_CLIENT_ID", "https://example.com/token", now)
+			if err != nil {
+				t.Fatalf("Could not sign: %s", err)
+			}
+			parts := strings.Split(jwt, ".")
+			if len(parts) != 3 {
+				t.Fatalf("JWT wants 3 parts but %d", len(parts))
+			}
+			var header map[string]string
+			decodeJWTPart(t, parts[0], &header)
+			if header["alg"] != c.alg || header["kid"] != "KEY_ID" {
+				t.Errorf("header wants alg=%s and kid=KEY_ID but %v", c.alg, header)
+			}
+			var claims map[string]interface{}
+			decodeJWTPart(t, parts[1], &claims)
+			for key, want := range map[string]interface{}{
+				"iss": "YOUR_CLIENT_ID",
+				"sub": "YOUR_CLIENT_ID",
+				"aud": "https://example.com/token",
+				"iat": float64(now.Unix()),
+				"exp": float64(now.Add(5 * time.Minute).Unix()),
+			} {
+				if claims[key] != want {
+					t.Errorf("%s wants %v but %v", key, want, claims[key])
+				}
+			}
+			if claims["jti"] == "" || claims["jti"] == nil {
+				t.Errorf("jti wants non-empty but %v", claims["jti"])
+			}
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatalf("Could not decode the signature: %s", err)
+			}
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if !c.verify(digest[:], sig) {
+				t.Errorf("signature is invalid")
+			}
+		})
+	}
+}
+
+func TestClientAssertion_Sign_UnsupportedKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	a := &ClientAssertion{Key: key}
+	if _, err := a.sign("YOUR_CLIENT_ID", "https://example.com/token", time.Now()); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+// opaqueSigner hides the type of the private key, like a signer backed by HSM or KMS.
+type opaqueSigner struct{ s crypto.Signer }
+
+func (o opaqueSigner) Public() crypto.PublicKey { return o.s.Public() }
+func (o opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return o.s.Sign(rand, digest, opts)
+}
+
+func decodeJWTPart(t *testing.T, part string, v interface{}) {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatalf("Could not decode the JWT: %s", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("Could not decode the JWT: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// ClientCredentialsFlow provides flow with OAuth 2.0 Client Credentials Grant.
+// This is for a service-to-service client, and does not open a browser or local server.
+// See https://tools.ietf.org/html/rfc6749#section-4.4
+type ClientCredentialsFlow struct {
+	ClientSettings
+
+	// Additional parameters of the token request, e.g. audience or resource.
+	EndpointParams url.Values
+}
+
+var _ Flow = (*ClientCredentialsFlow)(nil)
+
+// GetToken sends a token request of the client_credentials grant and returns a token got from the provider.
+func (f *ClientCredentialsFlow) GetToken(ctx context.Context) (*oauth2.Token, error) {
+	r, err := f.GetTokenResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// GetTokenResult is same as GetToken but returns the result. See ClientSettings.
+func (f *ClientCredentialsFlow) GetTokenResult(ctx context.Context) (*Result, error) {
+	if err := checkTokenURL(f.Config.Endpoint.TokenURL); err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	for key, values := range f.EndpointParams {
+		v[key] = values
+	}
+	v.Set("grant_type", "client_credentials")
+	if len(f.Config.Scopes) > 0 {
+		v.Set("scope", strings.Join(f.Config.Scopes, " "))
+	}
+	tr, err := f.exchange(ctx, httpClient(ctx, f.HTTPClient), v)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get a token: %w", wrapTokenError(err))
+	}
+	return newResult(tr, "", ""), nil
+}
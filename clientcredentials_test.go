@@ -0,0 +1,73 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestClientCredentialsFlow_GetToken(t *testing.T) {
+	h := authServerHandler{
+		AccessToken: "ACCESS_TOKEN",
+		TokenType:   "bearer",
+		GrantType:   "client_credentials",
+		TokenParams: url.Values{"scope": {"read write"}},
+		Audience:    "https://api.example.com",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	f := &oauth2cli.ClientCredentialsFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     oauth2.Endpoint{TokenURL: s.URL + "/token"},
+			Scopes:       []string{"read", "write"},
+		}},
+		EndpointParams: url.Values{"audience": {"https://api.example.com"}},
+	}
+	token, err := f.GetToken(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+	if token.TokenType != "Bearer" {
+		t.Errorf("TokenType wants Bearer but %s", token.TokenType)
+	}
+	requests := h.ReceivedRequests("/token")
+	if len(requests) != 1 {
+		t.Fatalf("token requests wants 1 but %d", len(requests))
+	}
+	if w, g := "YOUR_CLIENT_ID:YOUR_CLIENT_SECRET", requests[0].BasicAuth; w != g {
+		t.Errorf("Basic auth wants %s but %s", w, g)
+	}
+}
+
+func TestClientCredentialsFlow_GetToken_Error(t *testing.T) {
+	h := authServerHandler{
+		GrantType:   "client_credentials",
+		TokenErrors: []string{"invalid_client", "invalid_client"},
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	f := &oauth2cli.ClientCredentialsFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     oauth2.Endpoint{TokenURL: s.URL + "/token"},
+		}},
+	}
+	_, err := f.GetToken(context.Background())
+	if code := oauth2cli.TokenErrorCode(err); code != "invalid_client" {
+		t.Errorf("error code wants invalid_client but %s (%v)", code, err)
+	}
+	// the provider rejected both styles of the client credentials
+	if h.TokenRequests() != 2 {
+		t.Errorf("token requests wants 2 but %d", h.TokenRequests())
+	}
+}
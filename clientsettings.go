@@ -0,0 +1,80 @@
+package oauth2cli
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// ClientSettings represents the settings of the client, which are shared by the flows
+// sending a token request without the browser, i.e. DeviceCodeFlow, ClientCredentialsFlow,
+// PasswordFlow and RefreshFlow. Each flow embeds this and has only the fields of its grant.
+//
+// Each flow provides GetTokenResult, which is same as GetToken but returns the result
+// with the members of the token response.
+type ClientSettings struct {
+	Config oauth2.Config // OAuth2 config. Config.RedirectURL and Endpoint.AuthURL are not used.
+
+	// How the client credentials are sent in the token request. Default to AuthStyleAutoDetect.
+	// A public client, i.e. Config.ClientSecret is empty, sends only client_id in the form by default.
+	AuthStyle AuthStyle
+
+	// Cache of the style detected by AuthStyleAutoDetect. Default to none.
+	AuthStyleCache *AuthStyleCache
+
+	// Authenticate the client by a JWT signed with the private key, i.e. private_key_jwt.
+	// If this is set, Config.ClientSecret is not sent and AuthStyle is ignored.
+	ClientAssertion *ClientAssertion
+
+	// HTTP client used for requests to the provider.
+	// Default to the client in the context as oauth2.HTTPClient if it is set.
+	// Otherwise a client which respects HTTP_PROXY, HTTPS_PROXY and NO_PROXY is used.
+	HTTPClient *http.Client
+
+	Logger Logger // Logger to write messages of the flow. Default to DefaultLogger.
+
+	// Write a summary of the token response via the Logger, for debugging.
+	// The access token and refresh token are redacted to the length and the last 4 characters.
+	// The ID token is never written, only whether it is present.
+	LogTokenResponse bool
+}
+
+func (s *ClientSettings) logger() Logger {
+	if s.Logger == nil {
+		return DefaultLogger
+	}
+	return s.Logger
+}
+
+// authStyle returns the style of the client credentials.
+// A public client sends only client_id in the form, unless the style is set explicitly.
+func (s *ClientSettings) authStyle() AuthStyle {
+	if s.ClientAssertion != nil {
+		return authStyleNone
+	}
+	if s.AuthStyle == AuthStyleAutoDetect && s.Config.ClientSecret == "" {
+		return AuthStyleInParams
+	}
+	return s.AuthStyle
+}
+
+// exchange sends a token request with the client credentials or the client assertion.
+// It returns the token with the normalized token type.
+func (s *ClientSettings) exchange(ctx context.Context, client *http.Client, form url.Values) (*tokenResponse, error) {
+	if s.ClientAssertion != nil {
+		if err := setClientAssertion(form, s.ClientAssertion, &s.Config); err != nil {
+			return nil, err
+		}
+	}
+	tr, err := tokenExchangeAutoDetect(ctx, client, &s.Config, form, s.authStyle(), s.AuthStyleCache, nil)
+	if err != nil {
+		return nil, err
+	}
+	normalizeTokenType(tr.Token)
+	if s.LogTokenResponse {
+		s.logger().Log(newTokenResponseLogMessage(tr.Token, tr.Raw))
+	}
+	return tr, nil
+}
@@ -0,0 +1,282 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DeviceCodeFlow provides flow with OAuth 2.0 Device Authorization Grant.
+// This does not require a browser or local server on the machine,
+// e.g. a headless server or container. The user authorizes the device on another device.
+// See https://tools.ietf.org/html/rfc8628
+type DeviceCodeFlow struct {
+	ClientSettings
+
+	// URL of the device authorization endpoint of the provider.
+	DeviceAuthURL string
+
+	// Issuer URL of the provider.
+	// If this is set, DeviceAuthURL and Config.Endpoint.TokenURL are resolved by the discovery document if they are empty.
+	// See Discover for details.
+	Issuer string
+
+	// Called with the user code and verification URI, to show them to the user.
+	// Default to show a message via the Logger.
+	ShowUserCode func(d DeviceAuthorization)
+
+	// Polling interval of the token request if the provider does not advertise it.
+	// Default to 5 seconds, as the spec.
+	Interval time.Duration
+}
+
+var _ Flow = (*DeviceCodeFlow)(nil)
+
+var (
+	// ErrAccessDenied is returned if the user denied the authorization request of the device.
+	ErrAccessDenied = errors.New("Access denied")
+
+	// ErrDeviceCodeExpired is returned if the user did not authorize the device before the device code expired.
+	ErrDeviceCodeExpired = errors.New("Device code expired")
+)
+
+const (
+	deviceCodeGrantType     = "urn:ietf:params:oauth:grant-type:device_code"
+	defaultDeviceInterval   = 5 * time.Second
+	defaultDeviceExpiration = 10 * time.Minute
+)
+
+// slowDownIncrement is added to the interval on slow_down error.
+// See https://tools.ietf.org/html/rfc8628#section-3.5
+var slowDownIncrement = 5 * time.Second
+
+// DeviceAuthorization represents a response of the device authorization request.
+// See https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuthorization struct {
+	DeviceCode              string
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string        // URI with the user code, e.g. for a QR code. Empty if the provider does not support it.
+	ExpiresIn               time.Duration // Lifetime of the device code.
+	Interval                time.Duration // Polling interval. Zero if the provider does not advertise it.
+}
+
+type deviceAuthorizationJSON struct {
+	DeviceCode              string         `json:"device_code"`
+	UserCode                string         `json:"user_code"`
+	VerificationURI         string         `json:"verification_uri"`
+	VerificationURL         string         `json:"verification_url"` // Google uses this instead of verification_uri
+	VerificationURIComplete string         `json:"verification_uri_complete"`
+	ExpiresIn               expirationTime `json:"expires_in"`
+	Interval                expirationTime `json:"interval"`
+}
+
+// GetToken performs the Device Authorization Grant Flow and returns a token got from the provider.
+//
+// This performs the following steps:
+//
+//  1. Send a device authorization request.
+//  2. Show the user code and verification URI by ShowUserCode.
+//  3. Poll the token endpoint until the user authorizes the device on another device.
+//
+// The polling interval is increased by 5 seconds on slow_down error.
+// It returns an error which wraps ErrAccessDenied if the user denied,
+// or ErrDeviceCodeExpired if the device code expired.
+func (f *DeviceCodeFlow) GetToken(ctx context.Context) (*oauth2.Token, error) {
+	r, err := f.GetTokenResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// GetTokenResult is same as GetToken but returns the result. See ClientSettings.
+func (f *DeviceCodeFlow) GetTokenResult(ctx context.Context) (*Result, error) {
+	client := httpClient(ctx, f.HTTPClient)
+	flow, err := f.configure(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if flow.DeviceAuthURL == "" {
+		return nil, errors.New("DeviceAuthURL is required")
+	}
+	if err := checkTokenURL(flow.Config.Endpoint.TokenURL); err != nil {
+		return nil, err
+	}
+	return flow.run(ctx, client)
+}
+
+// configure returns a copy of the flow.
+// If Issuer is set, it resolves the empty endpoints by the discovery.
+func (f *DeviceCodeFlow) configure(ctx context.Context, client *http.Client) (*DeviceCodeFlow, error) {
+	flow := *f
+	if f.Issuer == "" || (f.DeviceAuthURL != "" && f.Config.Endpoint.TokenURL != "") {
+		return &flow, nil
+	}
+	m, err := discover(ctx, client, f.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Could not discover the endpoint: %w", err)
+	}
+	if flow.DeviceAuthURL == "" {
+		if m.DeviceAuthorizationEndpoint == "" {
+			return nil, errors.New("Discovery document does not contain device_authorization_endpoint")
+		}
+		flow.DeviceAuthURL = m.DeviceAuthorizationEndpoint
+	}
+	if flow.Config.Endpoint.TokenURL == "" {
+		if m.TokenEndpoint == "" {
+			return nil, errors.New("Discovery document does not contain token_endpoint")
+		}
+		flow.Config.Endpoint.TokenURL = m.TokenEndpoint
+	}
+	return &flow, nil
+}
+
+func (f *DeviceCodeFlow) run(ctx context.Context, client *http.Client) (*Result, error) {
+	d, err := f.authorizeDevice(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get a device code: %w", err)
+	}
+	if f.ShowUserCode != nil {
+		f.ShowUserCode(*d)
+	} else {
+		f.logger().Log(LogMessage{
+			Event:   "device_code_shown",
+			Message: fmt.Sprintf("Open %s and enter the code %s", d.VerificationURI, d.UserCode),
+			Fields:  map[string]string{"url": d.VerificationURI, "user_code": d.UserCode},
+		})
+	}
+	tr, err := f.poll(ctx, client, d)
+	if err != nil {
+		return nil, fmt.Errorf("Could not exchange token: %w", err)
+	}
+	return newResult(tr, "", ""), nil
+}
+
+// deviceAuthStyle returns the style of the client credentials in the device authorization request.
+// It does not detect the style by the response, but uses the style detected by the token request if it is cached.
+func (f *DeviceCodeFlow) deviceAuthStyle() AuthStyle {
+	style := f.authStyle()
+	if style != AuthStyleAutoDetect {
+		return style
+	}
+	if cached, ok := f.AuthStyleCache.get(&f.Config); ok {
+		return cached
+	}
+	if providerAuthHeaderWorks(f.Config.Endpoint.TokenURL) {
+		return AuthStyleInHeader
+	}
+	return AuthStyleInParams
+}
+
+// authorizeDevice sends a device authorization request.
+// See https://tools.ietf.org/html/rfc8628#section-3.1
+func (f *DeviceCodeFlow) authorizeDevice(ctx context.Context, client *http.Client) (*DeviceAuthorization, error) {
+	v := url.Values{"client_id": {f.Config.ClientID}}
+	if len(f.Config.Scopes) > 0 {
+		v.Set("scope", strings.Join(f.Config.Scopes, " "))
+	}
+	style := f.deviceAuthStyle()
+	switch {
+	case style == authStyleNone && f.ClientAssertion != nil:
+		if err := setClientAssertion(v, f.ClientAssertion, &f.Config); err != nil {
+			return nil, err
+		}
+	case style == AuthStyleInParams && f.Config.ClientSecret != "":
+		v.Set("client_secret", f.Config.ClientSecret)
+	}
+	req, err := http.NewRequest("POST", f.DeviceAuthURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if style == AuthStyleInHeader {
+		req.SetBasicAuth(url.QueryEscape(f.Config.ClientID), url.QueryEscape(f.Config.ClientSecret))
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the device authorization response: %w", err)
+	}
+	if code := resp.StatusCode; code < 200 || code > 299 {
+		return nil, &oauth2.RetrieveError{Response: resp, Body: body}
+	}
+	var dj deviceAuthorizationJSON
+	if err := json.Unmarshal(body, &dj); err != nil {
+		return nil, unexpectedTokenResponse(resp, body, err)
+	}
+	if dj.DeviceCode == "" || dj.UserCode == "" {
+		return nil, unexpectedTokenResponse(resp, body, errors.New("Device authorization response does not contain device_code or user_code"))
+	}
+	d := &DeviceAuthorization{
+		DeviceCode:              dj.DeviceCode,
+		UserCode:                dj.UserCode,
+		VerificationURI:         dj.VerificationURI,
+		VerificationURIComplete: dj.VerificationURIComplete,
+		ExpiresIn:               time.Duration(dj.ExpiresIn) * time.Second,
+		Interval:                time.Duration(dj.Interval) * time.Second,
+	}
+	if d.VerificationURI == "" {
+		d.VerificationURI = dj.VerificationURL
+	}
+	return d, nil
+}
+
+// poll sends the token request until the user authorizes the device.
+// See https://tools.ietf.org/html/rfc8628#section-3.4
+func (f *DeviceCodeFlow) poll(ctx context.Context, client *http.Client, d *DeviceAuthorization) (*tokenResponse, error) {
+	interval := d.Interval
+	if interval == 0 {
+		interval = durationOrDefault(f.Interval, defaultDeviceInterval)
+	}
+	expiration := time.After(durationOrDefault(d.ExpiresIn, defaultDeviceExpiration))
+	v := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {d.DeviceCode},
+	}
+	wait := interval
+	for {
+		select {
+		case <-time.After(wait):
+		case <-expiration:
+			return nil, ErrDeviceCodeExpired
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Context done while waiting for authorization of the device: %w", newContextError(ctx.Err()))
+		}
+		wait = interval
+		tr, err := f.exchange(ctx, client, v)
+		if err == nil {
+			return tr, nil
+		}
+		switch tokenErrorCode(err) {
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDownIncrement
+			wait = interval
+		case "access_denied":
+			return nil, fmt.Errorf("%w: %s", ErrAccessDenied, err)
+		case "expired_token":
+			return nil, fmt.Errorf("%w: %s", ErrDeviceCodeExpired, err)
+		default:
+			if delay, ok := retryDelay(err, interval); ok {
+				wait = delay // transient error of the provider
+				continue
+			}
+			return nil, wrapTokenError(err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// newDeviceCodeAuthServerHandler returns a fake provider of the device authorization grant.
+// The token endpoint returns the errors in order, and then the token.
+func newDeviceCodeAuthServerHandler(tokenErrors ...string) *authServerHandler {
+	return &authServerHandler{
+		AccessToken: "ACCESS_TOKEN",
+		TokenType:   "bearer",
+		GrantType:   "urn:ietf:params:oauth:grant-type:device_code",
+		TokenParams: url.Values{"device_code": {"DEVICE_CODE"}, "client_id": {"YOUR_CLIENT_ID"}},
+		TokenErrors: tokenErrors,
+		DeviceCode:  "DEVICE_CODE",
+		UserCode:    "ABCD-EFGH",
+	}
+}
+
+func newDeviceCodeFlow(serverURL string) *oauth2cli.DeviceCodeFlow {
+	return &oauth2cli.DeviceCodeFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{
+			ClientID: "YOUR_CLIENT_ID",
+			Endpoint: oauth2.Endpoint{TokenURL: serverURL + "/token"},
+			Scopes:   []string{"openid", "email"},
+		}},
+		DeviceAuthURL: serverURL + "/device",
+		Interval:      10 * time.Millisecond,
+		ShowUserCode:  func(oauth2cli.DeviceAuthorization) {},
+	}
+}
+
+func TestDeviceCodeFlow_GetToken(t *testing.T) {
+	defer func(d time.Duration) { *oauth2cli.SlowDownIncrement = d }(*oauth2cli.SlowDownIncrement)
+	*oauth2cli.SlowDownIncrement = 100 * time.Millisecond
+
+	h := newDeviceCodeAuthServerHandler("authorization_pending", "slow_down", "authorization_pending")
+	s := httptest.NewServer(h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f := newDeviceCodeFlow(s.URL)
+	var shown oauth2cli.DeviceAuthorization
+	f.ShowUserCode = func(d oauth2cli.DeviceAuthorization) { shown = d }
+	token, err := f.GetToken(ctx)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+	if token.TokenType != "Bearer" {
+		t.Errorf("TokenType wants Bearer but %s", token.TokenType)
+	}
+	if shown.UserCode != "ABCD-EFGH" {
+		t.Errorf("UserCode wants ABCD-EFGH but %s", shown.UserCode)
+	}
+	if shown.VerificationURI != "https://example.com/device" {
+		t.Errorf("VerificationURI wants https://example.com/device but %s", shown.VerificationURI)
+	}
+	devices := h.ReceivedRequests("/device")
+	if len(devices) != 1 {
+		t.Fatalf("device authorization requests wants 1 but %d", len(devices))
+	}
+	if w, g := "openid email", devices[0].Form.Get("scope"); w != g {
+		t.Errorf("scope wants %s but %s", w, g)
+	}
+	polls := h.ReceivedRequests("/token")
+	if len(polls) != 4 {
+		t.Fatalf("token requests wants 4 but %d", len(polls))
+	}
+	// the interval after slow_down should be increased
+	if d := polls[3].ReceivedAt.Sub(polls[2].ReceivedAt); d < *oauth2cli.SlowDownIncrement {
+		t.Errorf("interval after slow_down wants >= %s but %s", *oauth2cli.SlowDownIncrement, d)
+	}
+}
+
+func TestDeviceCodeFlow_GetToken_Error(t *testing.T) {
+	for _, c := range []struct {
+		code string
+		want error
+	}{
+		{"access_denied", oauth2cli.ErrAccessDenied},
+		{"expired_token", oauth2cli.ErrDeviceCodeExpired},
+	} {
+		t.Run(c.code, func(t *testing.T) {
+			h := newDeviceCodeAuthServerHandler("authorization_pending", c.code)
+			s := httptest.NewServer(h)
+			defer s.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			f := newDeviceCodeFlow(s.URL)
+			_, err := f.GetToken(ctx)
+			if !errors.Is(err, c.want) {
+				t.Errorf("err wants %s but %v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestDeviceCodeFlow_GetToken_ContextDone(t *testing.T) {
+	tokenErrors := make([]string, 1000)
+	for i := range tokenErrors {
+		tokenErrors[i] = "authorization_pending"
+	}
+	h := newDeviceCodeAuthServerHandler(tokenErrors...)
+	s := httptest.NewServer(h)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	f := newDeviceCodeFlow(s.URL)
+	_, err := f.GetToken(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but %v", err)
+	}
+}
+
+func TestDeviceCodeFlow_GetToken_Issuer(t *testing.T) {
+	h := newDeviceCodeAuthServerHandler()
+	var issuer string
+	m := http.NewServeMux()
+	m.Handle("/", h)
+	m.HandleFunc("/.well-known/oauth-authorization-server", func(w http.ResponseWriter, r *http.Request) {
+		// RFC 8414 allows to omit authorization_endpoint if the provider does not support the code grant
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":%q,"token_endpoint":"%s/token","device_authorization_endpoint":"%s/device"}`, issuer, issuer, issuer)
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+	issuer = s.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f := newDeviceCodeFlow("")
+	f.Config.Endpoint = oauth2.Endpoint{}
+	f.DeviceAuthURL = ""
+	f.Issuer = issuer
+	token, err := f.GetToken(ctx)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+}
@@ -0,0 +1,147 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// DiscoverEndpoint returns the endpoint of the OpenID Connect provider,
+// from the discovery document at /.well-known/openid-configuration of the issuer.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html
+//
+// The discovery request is sent via the default client of ClientSettings.HTTPClient.
+func DiscoverEndpoint(ctx context.Context, issuer string) (oauth2.Endpoint, error) {
+	return DiscoverEndpointWithOptions(ctx, issuer, DiscoveryOptions{})
+}
+
+// DiscoverEndpointWithOptions is same as DiscoverEndpoint but the request is sent with the options.
+func DiscoverEndpointWithOptions(ctx context.Context, issuer string, o DiscoveryOptions) (oauth2.Endpoint, error) {
+	m, err := DiscoverWithOptions(ctx, issuer, o)
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+	if err := m.checkEndpoint(); err != nil {
+		return oauth2.Endpoint{}, err
+	}
+	return m.Endpoint(), nil
+}
+
+// Discover returns the metadata of the provider from the discovery document of the issuer.
+// It does not check the endpoints, because each flow requires different ones.
+// It tries the OpenID Connect discovery at /.well-known/openid-configuration first,
+// and then the OAuth 2.0 authorization server metadata at /.well-known/oauth-authorization-server
+// if the provider does not have the former.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html and https://tools.ietf.org/html/rfc8414
+//
+// The discovery request is sent via the default client of ClientSettings.HTTPClient.
+func Discover(ctx context.Context, issuer string) (*ProviderMetadata, error) {
+	return DiscoverWithOptions(ctx, issuer, DiscoveryOptions{})
+}
+
+// DiscoverWithOptions is same as Discover but the request is sent with the options.
+func DiscoverWithOptions(ctx context.Context, issuer string, o DiscoveryOptions) (*ProviderMetadata, error) {
+	return discover(ctx, httpClient(ctx, o.HTTPClient), issuer)
+}
+
+// DiscoveryOptions represents the options of the discovery request.
+type DiscoveryOptions struct {
+	// HTTP client used for the discovery request.
+	// Default to the same client as ClientSettings.HTTPClient.
+	HTTPClient *http.Client
+}
+
+// ProviderMetadata represents the discovery document of a provider.
+// An endpoint is empty if the provider does not advertise it.
+type ProviderMetadata struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	UserinfoEndpoint            string `json:"userinfo_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// Endpoint returns the endpoint for oauth2.Config.
+func (m *ProviderMetadata) Endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{AuthURL: m.AuthorizationEndpoint, TokenURL: m.TokenEndpoint}
+}
+
+// checkEndpoint returns an error if the endpoint for AuthCodeFlow is not advertised.
+func (m *ProviderMetadata) checkEndpoint() error {
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" {
+		return errors.New("Discovery document does not contain authorization_endpoint or token_endpoint")
+	}
+	return nil
+}
+
+// errDiscoveryNotFound is returned if the discovery document does not exist.
+var errDiscoveryNotFound = errors.New("Discovery document not found")
+
+func discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	m, err := getProviderMetadata(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+	if errors.Is(err, errDiscoveryNotFound) {
+		u, uErr := authorizationServerMetadataURL(issuer)
+		if uErr != nil {
+			return nil, fmt.Errorf("Invalid issuer %s: %w", issuer, uErr)
+		}
+		m, err = getProviderMetadata(ctx, client, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The issuer must be identical to the document, but a trailing slash is ignored for convenience.
+	if strings.TrimSuffix(m.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("Issuer of the discovery document wants %s but %s", issuer, m.Issuer)
+	}
+	return m, nil
+}
+
+// authorizationServerMetadataURL returns the URL of the authorization server metadata.
+// The well-known path is inserted between the host and path of the issuer.
+// See https://tools.ietf.org/html/rfc8414#section-3.1
+func authorizationServerMetadataURL(issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/.well-known/oauth-authorization-server" + strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func getProviderMetadata(ctx context.Context, client *http.Client, u string) (*ProviderMetadata, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid discovery URL %s: %w", u, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the discovery document: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w at %s", errDiscoveryNotFound, u)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not get the discovery document from %s: %s", u, resp.Status)
+	}
+	var m ProviderMetadata
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("Could not parse the discovery document: %w", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,180 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestDiscoverEndpoint(t *testing.T) {
+	var issuer string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+  "issuer": %q,
+  "authorization_endpoint": "%s/auth",
+  "token_endpoint": "%s/token"
+}`, issuer, issuer, issuer)
+	}))
+	defer s.Close()
+	issuer = s.URL
+
+	for _, given := range []string{issuer, issuer + "/"} {
+		endpoint, err := oauth2cli.DiscoverEndpoint(context.Background(), given)
+		if err != nil {
+			t.Fatalf("Could not discover the endpoint: %s", err)
+		}
+		if want := issuer + "/auth"; endpoint.AuthURL != want {
+			t.Errorf("AuthURL wants %s but %s", want, endpoint.AuthURL)
+		}
+		if want := issuer + "/token"; endpoint.TokenURL != want {
+			t.Errorf("TokenURL wants %s but %s", want, endpoint.TokenURL)
+		}
+	}
+
+	if _, err := oauth2cli.DiscoverEndpoint(context.Background(), issuer+"/tenant"); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestDiscover_AuthorizationServerMetadata(t *testing.T) {
+	var issuer string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/oauth-authorization-server/tenant" {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+  "issuer": %q,
+  "authorization_endpoint": "%s/auth",
+  "token_endpoint": "%s/token",
+  "userinfo_endpoint": "%s/userinfo",
+  "jwks_uri": "%s/jwks",
+  "device_authorization_endpoint": "%s/device"
+}`, issuer, issuer, issuer, issuer, issuer, issuer)
+	}))
+	defer s.Close()
+	issuer = s.URL + "/tenant"
+
+	m, err := oauth2cli.Discover(context.Background(), issuer)
+	if err != nil {
+		t.Fatalf("Could not discover the provider: %s", err)
+	}
+	want := oauth2cli.ProviderMetadata{
+		Issuer:                      issuer,
+		AuthorizationEndpoint:       issuer + "/auth",
+		TokenEndpoint:               issuer + "/token",
+		UserinfoEndpoint:            issuer + "/userinfo",
+		JWKSURI:                     issuer + "/jwks",
+		DeviceAuthorizationEndpoint: issuer + "/device",
+	}
+	if *m != want {
+		t.Errorf("metadata wants %+v but %+v", want, *m)
+	}
+}
+
+func TestDiscoverWithOptions(t *testing.T) {
+	var issuer string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%s/auth", "token_endpoint": "%s/token"}`, issuer, issuer, issuer)
+	}))
+	defer s.Close()
+	issuer = s.URL
+
+	transport := &countTransport{}
+	o := oauth2cli.DiscoveryOptions{HTTPClient: &http.Client{Transport: transport}}
+	if _, err := oauth2cli.DiscoverWithOptions(context.Background(), issuer, o); err != nil {
+		t.Fatalf("Could not discover the provider: %s", err)
+	}
+	endpoint, err := oauth2cli.DiscoverEndpointWithOptions(context.Background(), issuer, o)
+	if err != nil {
+		t.Fatalf("Could not discover the endpoint: %s", err)
+	}
+	if want := issuer + "/token"; endpoint.TokenURL != want {
+		t.Errorf("TokenURL wants %s but %s", want, endpoint.TokenURL)
+	}
+	if transport.Count() != 2 {
+		t.Errorf("requests via HTTPClient wants 2 but %d", transport.Count())
+	}
+}
+
+func TestAuthCodeFlow_Issuer(t *testing.T) {
+	var issuer string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%s/auth","token_endpoint":"%s/token"}`, issuer, issuer, issuer)
+	}))
+	defer s.Close()
+	issuer = s.URL
+
+	flow := &oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{ClientID: "YOUR_CLIENT_ID"},
+		Issuer: issuer,
+	}
+	u, err := flow.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("AuthCodeURL error: %s", err)
+	}
+	if !strings.HasPrefix(u, issuer+"/auth?") {
+		t.Errorf("URL wants prefix %s/auth? but %s", issuer, u)
+	}
+}
+
+func TestAuthCodeFlow_Issuer_Timeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	flow := &oauth2cli.AuthCodeFlow{
+		Config:  oauth2.Config{ClientID: "YOUR_CLIENT_ID"},
+		Issuer:  s.URL,
+		Timeout: 100 * time.Millisecond,
+	}
+	_, err := flow.AuthCodeURL(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but %v", err)
+	}
+}
+
+func TestAuthCodeFlow_Issuer_Timeout_WholeFlow(t *testing.T) {
+	var issuer string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%s/auth","token_endpoint":"%s/token"}`, issuer, issuer, issuer)
+	}))
+	defer s.Close()
+	issuer = s.URL
+
+	flow := &oauth2cli.AuthCodeFlow{
+		Config:             oauth2.Config{ClientID: "YOUR_CLIENT_ID"},
+		Issuer:             issuer,
+		Timeout:            500 * time.Millisecond,
+		SkipOpenBrowser:    true,
+		ShowLocalServerURL: func(url string) {},
+	}
+	start := time.Now()
+	_, err := flow.GetToken(context.Background())
+	if !errors.Is(err, oauth2cli.ErrFlowTimeout) {
+		t.Errorf("err wants ErrFlowTimeout but %v", err)
+	}
+	// the discovery is included in Timeout
+	if d := time.Since(start); d > 700*time.Millisecond {
+		t.Errorf("duration wants about 500ms but %s", d)
+	}
+}
@@ -0,0 +1,92 @@
+package oauth2cli
+
+import (
+	"time"
+)
+
+// EventType represents a stage of the flow.
+type EventType int
+
+// Events of the flow, in the order of occurrence.
+const (
+	EventServerStarted EventType = iota + 1 // The local server is started.
+	EventBrowserOpened                      // The local server URL is shown and the browser is opened. Event.Err is set if the browser could not be opened.
+	EventWaiting                            // Waiting for the authorization response.
+	EventCodeReceived                       // A valid authorization code is received.
+	EventExchanging                         // Sending the token request.
+	EventDone                               // The flow is finished. Event.Err is set if the flow failed.
+)
+
+// String returns the name of the event type, e.g. ServerStarted.
+func (t EventType) String() string {
+	switch t {
+	case EventServerStarted:
+		return "ServerStarted"
+	case EventBrowserOpened:
+		return "BrowserOpened"
+	case EventWaiting:
+		return "Waiting"
+	case EventCodeReceived:
+		return "CodeReceived"
+	case EventExchanging:
+		return "Exchanging"
+	case EventDone:
+		return "Done"
+	}
+	return "Unknown"
+}
+
+// Event represents a transition of the flow.
+type Event struct {
+	Type EventType
+	Time time.Time // When the event occurred.
+	URL  string    // URL of the local server for EventServerStarted, or the URL opened in the browser for EventBrowserOpened.
+	Err  error     // Set for EventDone if the flow failed, or EventBrowserOpened if the browser could not be opened.
+
+	// Authorization URL of the provider for EventServerStarted and EventBrowserOpened,
+	// e.g. to show it as a QR code for another device.
+	AuthURL string
+}
+
+// eventBufferSize is large enough to hold all events of a flow.
+const eventBufferSize = 16
+
+// eventDispatcher calls the handler in another goroutine in order of the events,
+// so that a slow handler does not block the flow.
+// A nil dispatcher discards events.
+type eventDispatcher struct {
+	ch chan Event
+}
+
+func newEventDispatcher(handler func(Event)) *eventDispatcher {
+	if handler == nil {
+		return nil
+	}
+	d := &eventDispatcher{ch: make(chan Event, eventBufferSize)}
+	go func() {
+		for e := range d.ch {
+			handler(e)
+		}
+	}()
+	return d
+}
+
+func (d *eventDispatcher) emit(e Event) {
+	if d == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case d.ch <- e:
+	default:
+		// Drop the event rather than blocking the flow.
+	}
+}
+
+// close stops the dispatcher after the handler received all events.
+func (d *eventDispatcher) close() {
+	if d == nil {
+		return
+	}
+	close(d.ch)
+}
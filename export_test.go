@@ -0,0 +1,8 @@
+package oauth2cli
+
+// Export the internals for the tests in oauth2cli_test.
+var (
+	SlowDownIncrement = &slowDownIncrement
+	TokenErrorCode    = tokenErrorCode
+	ECDSADERToRaw     = ecdsaDERToRaw
+)
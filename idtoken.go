@@ -0,0 +1,311 @@
+package oauth2cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidIDToken is returned if the ID token could not be verified.
+var ErrInvalidIDToken = errors.New("Invalid ID token")
+
+const defaultIDTokenClockSkew = time.Minute
+
+// IDTokenVerifier verifies an ID token by the JWKS of the provider.
+// It verifies the signature and claims of iss, aud, exp and nonce.
+// See https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+//
+// The JWKS is cached in the verifier, and fetched again if the key of an ID token is not found,
+// e.g. the provider rotated the keys. It is safe for concurrent use.
+type IDTokenVerifier struct {
+	Issuer   string // Required. Issuer URL of the provider, which must be identical to iss claim.
+	ClientID string // Required. Client ID, which must be contained in aud claim.
+
+	// URL of the JWKS of the provider.
+	// Default to jwks_uri of the discovery document of the issuer.
+	JWKSURL string
+
+	// Tolerance of the clock difference from the provider on exp claim. Default to 1 minute.
+	ClockSkew time.Duration
+
+	// HTTP client used for requests to the provider.
+	// Default to the same client as ClientSettings.HTTPClient.
+	HTTPClient *http.Client
+
+	mu   sync.Mutex
+	keys []jsonWebKey
+}
+
+// Verify verifies the ID token and returns the claims.
+// If nonce is not empty, nonce claim must be identical to it.
+// It returns an error which wraps ErrInvalidIDToken if the ID token is invalid.
+func (v *IDTokenVerifier) Verify(ctx context.Context, idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: JWT must have 3 parts but %d", ErrInvalidIDToken, len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: could not decode the header: %s", ErrInvalidIDToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode the signature: %s", ErrInvalidIDToken, err)
+	}
+	if err := v.verifySignature(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: could not decode the payload: %s", ErrInvalidIDToken, err)
+	}
+	if err := v.verifyClaims(claims, nonce); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIDToken, err)
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (v *IDTokenVerifier) verifyClaims(claims map[string]interface{}, nonce string) error {
+	if iss, _ := claims["iss"].(string); iss != v.Issuer {
+		return fmt.Errorf("iss wants %s but %s", v.Issuer, iss)
+	}
+	if !audienceContains(claims["aud"], v.ClientID) {
+		return fmt.Errorf("aud does not contain %s", v.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("exp is missing")
+	}
+	expiry := time.Unix(int64(exp), 0)
+	if nowFunc().After(expiry.Add(durationOrDefault(v.ClockSkew, defaultIDTokenClockSkew))) {
+		return fmt.Errorf("token expired at %s", expiry)
+	}
+	if nonce != "" {
+		if got, _ := claims["nonce"].(string); got != nonce {
+			return errors.New("nonce did not match")
+		}
+	}
+	return nil
+}
+
+// audienceContains returns true if aud claim, i.e. a string or an array of strings, contains the client ID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, e := range a {
+			if s, _ := e.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *IDTokenVerifier) verifySignature(ctx context.Context, alg, kid, signingInput string, sig []byte) error {
+	hash, kty, ok := signingAlgorithm(alg)
+	if !ok {
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidIDToken, alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+	for refreshed := false; ; refreshed = true {
+		keys, err := v.getKeys(ctx, refreshed)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, k := range keys {
+			if k.Kty != kty || k.Use == "enc" || (kid != "" && k.Kid != kid) {
+				continue
+			}
+			found = true
+			pub, err := k.publicKey()
+			if err != nil {
+				continue
+			}
+			if verifyWithKey(pub, hash, digest, sig) {
+				return nil
+			}
+		}
+		if found || refreshed {
+			return fmt.Errorf("%w: signature could not be verified by the JWKS", ErrInvalidIDToken)
+		}
+	}
+}
+
+// signingAlgorithm returns the hash and key type of the JWS algorithm.
+// See https://tools.ietf.org/html/rfc7518#section-3.1
+func signingAlgorithm(alg string) (crypto.Hash, string, bool) {
+	switch alg {
+	case "RS256":
+		return crypto.SHA256, "RSA", true
+	case "RS384":
+		return crypto.SHA384, "RSA", true
+	case "RS512":
+		return crypto.SHA512, "RSA", true
+	case "ES256":
+		return crypto.SHA256, "EC", true
+	case "ES384":
+		return crypto.SHA384, "EC", true
+	case "ES512":
+		return crypto.SHA512, "EC", true
+	}
+	return 0, "", false
+}
+
+func verifyWithKey(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS has the raw form of r || s.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// getKeys returns the cached keys, or fetches the JWKS if it is not cached or refresh is true.
+func (v *IDTokenVerifier) getKeys(ctx context.Context, refresh bool) ([]jsonWebKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil && !refresh {
+		return v.keys, nil
+	}
+	client := httpClient(ctx, v.HTTPClient)
+	jwksURL := v.JWKSURL
+	if jwksURL == "" {
+		m, err := discover(ctx, client, v.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("Could not discover the JWKS: %w", err)
+		}
+		if m.JWKSURI == "" {
+			return nil, errors.New("Discovery document does not contain jwks_uri")
+		}
+		jwksURL = m.JWKSURI
+	}
+	keys, err := fetchJWKS(ctx, client, jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	return keys, nil
+}
+
+// jsonWebKey represents a public key in the JWKS.
+// See https://tools.ietf.org/html/rfc7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported crv %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported kty %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, jwksURL string) ([]jsonWebKey, error) {
+	req, err := http.NewRequest("GET", jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWKS URL %s: %w", jwksURL, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the JWKS: %w", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not get the JWKS from %s: %s", jwksURL, resp.Status)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, fmt.Errorf("Could not parse the JWKS: %w", err)
+	}
+	return jwks.Keys, nil
+}
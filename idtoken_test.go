@@ -0,0 +1,211 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+// signIDToken returns a JWT of the claims signed by the key.
+func signIDToken(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Could not sign: %s", err)
+	}
+	if alg == "ES256" {
+		if sig, err = oauth2cli.ECDSADERToRaw(sig); err != nil {
+			t.Fatalf("Could not convert the signature: %s", err)
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func publicJWK(key crypto.Signer, kid string) map[string]string {
+	enc := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": enc(k.N), "e": enc(big.NewInt(int64(k.E)))}
+	case *ecdsa.PrivateKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": enc(k.X), "y": enc(k.Y)}
+	}
+	return nil
+}
+
+func TestIDTokenVerifier_Verify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	h := authServerHandler{JWKS: []map[string]string{publicJWK(rsaKey, "rsa"), publicJWK(ecKey, "ec")}}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "https://issuer.example.com", "aud": "YOUR_CLIENT_ID", "exp": exp, "nonce": "NONCE"}
+	}
+	for _, c := range []struct {
+		name    string
+		key     crypto.Signer
+		kid     string
+		modify  func(claims map[string]interface{})
+		wantErr bool
+	}{
+		{name: "RS256", key: rsaKey, kid: "rsa"},
+		{name: "ES256", key: ecKey, kid: "ec"},
+		{name: "NoKeyID", key: ecKey},
+		{name: "AudienceArray", key: rsaKey, kid: "rsa", modify: func(m map[string]interface{}) {
+			m["aud"] = []string{"another", "YOUR_CLIENT_ID"}
+		}},
+		{name: "InvalidSignature", key: otherKey, kid: "rsa", wantErr: true},
+		{name: "InvalidIssuer", key: rsaKey, kid: "rsa", wantErr: true, modify: func(m map[string]interface{}) {
+			m["iss"] = "https://another.example.com"
+		}},
+		{name: "InvalidAudience", key: rsaKey, kid: "rsa", wantErr: true, modify: func(m map[string]interface{}) {
+			m["aud"] = "another"
+		}},
+		{name: "Expired", key: rsaKey, kid: "rsa", wantErr: true, modify: func(m map[string]interface{}) {
+			m["exp"] = time.Now().Add(-time.Hour).Unix()
+		}},
+		{name: "InvalidNonce", key: rsaKey, kid: "rsa", wantErr: true, modify: func(m map[string]interface{}) {
+			m["nonce"] = "another"
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			claims := validClaims()
+			if c.modify != nil {
+				c.modify(claims)
+			}
+			idToken := signIDToken(t, c.key, c.kid, claims)
+			v := &oauth2cli.IDTokenVerifier{Issuer: "https://issuer.example.com", ClientID: "YOUR_CLIENT_ID", JWKSURL: s.URL + "/jwks"}
+			got, err := v.Verify(context.Background(), idToken, "NONCE")
+			if c.wantErr {
+				if !errors.Is(err, oauth2cli.ErrInvalidIDToken) {
+					t.Errorf("err wants ErrInvalidIDToken but %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not verify the ID token: %s", err)
+			}
+			if got["nonce"] != "NONCE" {
+				t.Errorf("nonce wants NONCE but %v", got["nonce"])
+			}
+		})
+	}
+}
+
+func TestIDTokenVerifier_Verify_KeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	h := authServerHandler{JWKS: []map[string]string{publicJWK(oldKey, "old")}}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+
+	v := &oauth2cli.IDTokenVerifier{Issuer: "https://issuer.example.com", ClientID: "YOUR_CLIENT_ID", JWKSURL: s.URL + "/jwks"}
+	claims := map[string]interface{}{"iss": "https://issuer.example.com", "aud": "YOUR_CLIENT_ID", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := v.Verify(context.Background(), signIDToken(t, oldKey, "old", claims), ""); err != nil {
+		t.Fatalf("Could not verify the ID token: %s", err)
+	}
+	h.mu.Lock()
+	h.JWKS = []map[string]string{publicJWK(newKey, "new")}
+	h.mu.Unlock()
+	if _, err := v.Verify(context.Background(), signIDToken(t, newKey, "new", claims), ""); err != nil {
+		t.Fatalf("Could not verify the ID token: %s", err)
+	}
+	if n := len(h.ReceivedRequests("/jwks")); n != 2 {
+		t.Errorf("JWKS requests wants 2 but %d", n)
+	}
+}
+
+func TestAuthCodeFlow_Exchange_IDTokenVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	claims := func(nonce string) map[string]interface{} {
+		return map[string]interface{}{"iss": "https://issuer.example.com", "aud": "YOUR_CLIENT_ID", "exp": time.Now().Add(time.Hour).Unix(), "nonce": nonce}
+	}
+	for _, c := range []struct {
+		name    string
+		idToken string
+		wantErr error
+	}{
+		{"Valid", signIDToken(t, key, "rsa", claims("NONCE")), nil},
+		{"InvalidSignature", signIDToken(t, otherKey, "rsa", claims("NONCE")), oauth2cli.ErrInvalidIDToken},
+		{"InvalidNonce", signIDToken(t, key, "rsa", claims("another")), oauth2cli.ErrInvalidIDToken},
+		{"Missing", "", oauth2cli.ErrMissingIDToken},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := authServerHandler{
+				AuthCode:       "AUTH_CODE",
+				AccessToken:    "ACCESS_TOKEN",
+				TokenExtraJSON: fmt.Sprintf(`, "id_token": "%s"`, c.idToken),
+				JWKS:           []map[string]string{publicJWK(key, "rsa")},
+			}
+			s := httptest.NewServer(&h)
+			defer s.Close()
+			flow := oauth2cli.AuthCodeFlow{
+				Config: oauth2.Config{
+					ClientID:     "YOUR_CLIENT_ID",
+					ClientSecret: "YOUR_CLIENT_SECRET",
+					Endpoint:     oauth2.Endpoint{AuthURL: s.URL + "/auth", TokenURL: s.URL + "/token"},
+					RedirectURL:  "http://localhost:8000",
+				},
+				IDTokenVerifier: &oauth2cli.IDTokenVerifier{Issuer: "https://issuer.example.com", ClientID: "YOUR_CLIENT_ID", JWKSURL: s.URL + "/jwks"},
+				Nonce:           "NONCE",
+			}
+			_, err := flow.Exchange(context.Background(), "AUTH_CODE")
+			if c.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Could not exchange token: %s", err)
+				}
+				return
+			}
+			if !errors.Is(err, c.wantErr) {
+				t.Errorf("err wants %v but %v", c.wantErr, err)
+			}
+		})
+	}
+}
@@ -1,39 +1,138 @@
 package oauth2cli
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
+	"syscall"
 )
 
+// ErrPortInUse is returned if the local server port is already in use, e.g. by another flow.
+// The error also wraps the original error of the listen.
+var ErrPortInUse = errors.New("Port is in use")
+
+// PortRange returns the ports from min to max inclusive, e.g. for AuthCodeFlow.LocalServerPorts.
+// It returns nil if min is greater than max.
+func PortRange(min, max int) []int {
+	var ports []int
+	for port := min; port <= max; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
 type localhostListener struct {
 	net.Listener
 	Port int
 	URL  string
 }
 
-// newLocalhostListener starts a TCP listener on localhost.
+// newLocalhostListener starts a TCP listener on the host, i.e. localhost, a loopback IP literal or a bind address.
 // A random port is allocated if the port is 0.
-func newLocalhostListener(port int) (*localhostListener, error) {
-	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+// The scheme is used to build the URL, i.e. http or https.
+func newLocalhostListener(host string, port int, scheme string) (*localhostListener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		return nil, fmt.Errorf("Could not listen to port %d", port)
+		if isAddrInUse(err) {
+			err = &sentinelError{ErrPortInUse, err}
+		}
+		return nil, fmt.Errorf("Could not listen to port %d: %w", port, err)
+	}
+	// localhost should be resolved to the loopback address, but it depends on the hosts file.
+	// Do not expose the local server to the network by a misconfiguration.
+	if a, ok := l.Addr().(*net.TCPAddr); ok && host == "localhost" && !a.IP.IsLoopback() {
+		l.Close()
+		return nil, fmt.Errorf("Could not listen to port %d: localhost is resolved to non-loopback address %s", port, a.IP)
 	}
 	p, err := extractPort(l.Addr())
 	if err != nil {
+		l.Close()
 		return nil, fmt.Errorf("Could not determine listening port: %s", err)
 	}
-	url := fmt.Sprintf("http://localhost:%d", p)
+	url := fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(urlHost(l.Addr()), strconv.Itoa(p)))
 	return &localhostListener{l, p, url}, nil
 }
 
+// wsaeaddrinuse is the error code of the address in use on Windows.
+// syscall.EADDRINUSE does not match it, because it is an invented value on Windows.
+// See https://docs.microsoft.com/en-us/windows/win32/winsock/windows-sockets-error-codes-2
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// isAddrInUse returns true if the error of the listen is caused by the address in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, wsaeaddrinuse)
+}
+
+// newLocalhostListenerOnPorts starts a TCP listener on the first available port of the candidates.
+// A port in use is skipped, and any other error is returned immediately.
+// Since the listen is atomic, a port taken by another flow at the same time is skipped as well.
+func newLocalhostListenerOnPorts(host string, ports []int, scheme string) (*localhostListener, error) {
+	var lastErr error
+	for _, port := range ports {
+		l, err := newLocalhostListener(host, port, scheme)
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, ErrPortInUse) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("All ports %v are in use: %w", ports, lastErr)
+}
+
+// unclosableListener ignores Close, so that the listener given by the user is not closed by the caller.
+type unclosableListener struct {
+	net.Listener
+}
+
+func (l *unclosableListener) Close() error { return nil }
+
+// newCustomListener wraps the listener given by the user.
+// The URL is determined from the address if it is TCP.
+// Otherwise, e.g. a Unix domain socket, Port is 0 and URL is empty.
+func newCustomListener(l net.Listener, scheme string) *localhostListener {
+	if l.Addr().Network() != "tcp" {
+		return &localhostListener{Listener: l}
+	}
+	p, err := extractPort(l.Addr())
+	if err != nil {
+		return &localhostListener{Listener: l}
+	}
+	url := fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(urlHost(l.Addr()), strconv.Itoa(p)))
+	return &localhostListener{l, p, url}
+}
+
+// urlHost returns the host of the URL to the address.
+// It is localhost if the address is IPv4 loopback or unspecified,
+// or ::1 if the address is IPv6 loopback, because localhost may be resolved to IPv4 only.
+func urlHost(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP.To4() == nil && a.IP.IsLoopback() {
+		return "::1"
+	}
+	return "localhost"
+}
+
+// listenHost returns the host to listen on for the hostname of the redirect URL.
+// It is the IP address if the hostname is a loopback IP literal, e.g. 127.0.0.1 or ::1,
+// so that the browser connects to the same address as the listener.
+// Otherwise it is localhost, which may be resolved to either IPv4 or IPv6.
+func listenHost(redirectURLHostname string) string {
+	if ip := net.ParseIP(redirectURLHostname); ip != nil && ip.IsLoopback() {
+		return ip.String()
+	}
+	return "localhost"
+}
+
+// extractPort returns the port of the address.
+// It supports both IPv4 and IPv6, e.g. 127.0.0.1:8000 and [::1]:8000.
 func extractPort(addr net.Addr) (int, error) {
-	s := strings.SplitN(addr.String(), ":", 2)
-	if len(s) != 2 {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
 		return 0, fmt.Errorf("Invalid address: %s", addr)
 	}
-	p, err := strconv.Atoi(s[1])
+	p, err := strconv.Atoi(port)
 	if err != nil {
 		return 0, fmt.Errorf("Invalid port number %s: %s", addr, err)
 	}
@@ -0,0 +1,214 @@
+package oauth2cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestNewLocalhostListener_RandomPort(t *testing.T) {
+	l, err := newLocalhostListener("localhost", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	if l.Port == 0 {
+		t.Errorf("Port wants the allocated port but 0")
+	}
+	if want := fmt.Sprintf("http://localhost:%d", l.Port); l.URL != want {
+		t.Errorf("URL wants %s but %s", want, l.URL)
+	}
+}
+
+func TestNewLocalhostListener_PortInUse(t *testing.T) {
+	busy, err := newLocalhostListener("localhost", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer busy.Close()
+	_, err = newLocalhostListener("localhost", busy.Port, "http")
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("err wants ErrPortInUse but %v", err)
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("err wants EADDRINUSE but %v", err)
+	}
+}
+
+func TestNewLocalhostListenerOnPorts(t *testing.T) {
+	busy, err := newLocalhostListener("localhost", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer busy.Close()
+	free, err := newLocalhostListener("localhost", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	freePort := free.Port
+	free.Close()
+
+	l, err := newLocalhostListenerOnPorts("localhost", []int{busy.Port, freePort}, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	if l.Port != freePort {
+		t.Errorf("Port wants %d but %d", freePort, l.Port)
+	}
+
+	_, err = newLocalhostListenerOnPorts("localhost", []int{busy.Port, l.Port}, "http")
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("err wants ErrPortInUse but %v", err)
+	}
+}
+
+func TestExtractPort(t *testing.T) {
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000},
+		&net.TCPAddr{IP: net.IPv6loopback, Port: 8000},
+	} {
+		p, err := extractPort(addr)
+		if err != nil {
+			t.Errorf("extractPort(%s) returned error: %s", addr, err)
+		}
+		if p != 8000 {
+			t.Errorf("extractPort(%s) wants 8000 but %d", addr, p)
+		}
+	}
+}
+
+func TestNewCustomListener_IPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("Could not listen on IPv6 loopback: %s", err)
+	}
+	defer l.Close()
+	cl := newCustomListener(l, "http")
+	if want := fmt.Sprintf("http://[::1]:%d", cl.Port); cl.URL != want {
+		t.Errorf("URL wants %s but %s", want, cl.URL)
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"":            "localhost",
+		"localhost":   "localhost",
+		"127.0.0.1":   "127.0.0.1",
+		"127.0.0.2":   "127.0.0.2",
+		"::1":         "::1",
+		"example.com": "localhost",
+		"192.0.2.1":   "localhost",
+	} {
+		if got := listenHost(hostname); got != want {
+			t.Errorf("listenHost(%q) wants %s but %s", hostname, want, got)
+		}
+	}
+}
+
+func TestNewLocalhostListener_IPLiteral(t *testing.T) {
+	l, err := newLocalhostListener("127.0.0.1", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	if a, ok := l.Addr().(*net.TCPAddr); !ok || !a.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Addr wants 127.0.0.1 but %s", l.Addr())
+	}
+}
+
+func TestNewLocalhostListenerOnPorts_Concurrent(t *testing.T) {
+	const n = 5
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := newLocalhostListener("localhost", 0, "http")
+		if err != nil {
+			t.Fatalf("Could not listen: %s", err)
+		}
+		ports = append(ports, l.Port)
+		l.Close()
+	}
+	var wg sync.WaitGroup
+	listeners := make(chan *localhostListener, n)
+	for i := 0; i < n; i++ {
+		// each flow has the overlapping candidates in a different order
+		candidates := append(append([]int{}, ports[i:]...), ports[:i]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := newLocalhostListenerOnPorts("localhost", candidates, "http")
+			if err != nil {
+				t.Errorf("Could not listen: %s", err)
+				return
+			}
+			listeners <- l
+		}()
+	}
+	wg.Wait()
+	close(listeners)
+	seen := make(map[int]bool)
+	for l := range listeners {
+		defer l.Close()
+		if seen[l.Port] {
+			t.Errorf("port %d is allocated twice", l.Port)
+		}
+		seen[l.Port] = true
+	}
+	if len(seen) != n {
+		t.Errorf("ports wants %d distinct ports but %v", n, seen)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	if got := fmt.Sprint(PortRange(8000, 8003)); got != "[8000 8001 8002 8003]" {
+		t.Errorf("PortRange wants [8000 8001 8002 8003] but %s", got)
+	}
+	if got := PortRange(8001, 8000); got != nil {
+		t.Errorf("PortRange wants nil but %v", got)
+	}
+}
+
+func TestNewLocalhostListener_BindAddress(t *testing.T) {
+	l, err := newLocalhostListener("localhost", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("listener wants the loopback address by default but %s", ip)
+	}
+
+	all, err := newLocalhostListener("0.0.0.0", 0, "http")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer all.Close()
+	if ip := all.Addr().(*net.TCPAddr).IP; !ip.IsUnspecified() {
+		t.Errorf("listener wants the bind address 0.0.0.0 but %s", ip)
+	}
+	if want := fmt.Sprintf("http://localhost:%d", all.Port); all.URL != want {
+		t.Errorf("URL wants %s but %s", want, all.URL)
+	}
+}
+
+func TestIsAddrInUse(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"EADDRINUSE", &net.OpError{Op: "listen", Err: &os.SyscallError{Syscall: "bind", Err: syscall.EADDRINUSE}}, true},
+		{"WSAEADDRINUSE", &net.OpError{Op: "listen", Err: &os.SyscallError{Syscall: "bind", Err: syscall.Errno(10048)}}, true},
+		{"EACCES", &net.OpError{Op: "listen", Err: &os.SyscallError{Syscall: "bind", Err: syscall.EACCES}}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isAddrInUse(c.err); got != c.want {
+				t.Errorf("isAddrInUse wants %v but %v", c.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package oauth2cli
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// Logger is the interface to write messages of the flow.
+// Each message has structured fields, so you can format it as you like, e.g. JSON.
+type Logger interface {
+	Log(m LogMessage)
+}
+
+// LogMessage represents a message of the flow.
+type LogMessage struct {
+	Event   string            // Name of the event, e.g. server_started.
+	Message string            // Human readable message.
+	Fields  map[string]string // Structured fields, e.g. url.
+}
+
+// DefaultLogger writes the human readable message via the log package.
+var DefaultLogger Logger = defaultLogger{}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Log(m LogMessage) {
+	log.Print(m.Message)
+}
+
+// NewJSONLogger returns a Logger which writes each message as a line of JSON to the writer.
+// The line has the event, message and fields as keys, e.g.
+//
+//	{"event":"server_started","message":"Open http://localhost:8000 for authorization","url":"http://localhost:8000"}
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonLogger) Log(m LogMessage) {
+	v := make(map[string]string)
+	for k, f := range m.Fields {
+		v[k] = f
+	}
+	v["event"] = m.Event
+	v["message"] = m.Message
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
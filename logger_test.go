@@ -0,0 +1,27 @@
+package oauth2cli_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/int128/oauth2cli"
+)
+
+func TestNewJSONLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := oauth2cli.NewJSONLogger(&b)
+	l.Log(oauth2cli.LogMessage{
+		Event:   "server_started",
+		Message: "Open http://localhost:8000 for authorization",
+		Fields:  map[string]string{"url": "http://localhost:8000"},
+	})
+	want := `{"event":"server_started","message":"Open http://localhost:8000 for authorization","url":"http://localhost:8000"}` + "\n"
+	if b.String() != want {
+		t.Errorf("output wants %s but %s", want, b.String())
+	}
+}
+
+// loggerFunc is an adapter to use a function as oauth2cli.Logger.
+type loggerFunc func(m oauth2cli.LogMessage)
+
+func (f loggerFunc) Log(m oauth2cli.LogMessage) { f(m) }
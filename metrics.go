@@ -0,0 +1,30 @@
+package oauth2cli
+
+import (
+	"time"
+)
+
+// Metrics is the interface to observe durations of the phases of the flow.
+// The methods are called synchronously in the flow, so they should return quickly.
+type Metrics interface {
+	// ObserveAuthorization is called with the duration from the start of the local server
+	// to the authorization response, i.e. how long the user took to authorize.
+	// err is set if no valid authorization response was received.
+	ObserveAuthorization(d time.Duration, err error)
+
+	// ObserveTokenExchange is called with the duration of the token request, including retries.
+	// err is set if the token request failed.
+	ObserveTokenExchange(d time.Duration, err error)
+}
+
+func (f *AuthCodeFlow) observeAuthorization(start time.Time, err error) {
+	if f.Metrics != nil {
+		f.Metrics.ObserveAuthorization(time.Since(start), err)
+	}
+}
+
+func (f *AuthCodeFlow) observeTokenExchange(start time.Time, err error) {
+	if f.Metrics != nil {
+		f.Metrics.ObserveTokenExchange(time.Since(start), err)
+	}
+}
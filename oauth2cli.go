@@ -3,15 +3,87 @@
 package oauth2cli
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/binary"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
+// Flow is the interface of a flow to get a token, so that the caller can select the grant type at runtime.
+// All flows in this package implement this.
+type Flow interface {
+	GetToken(ctx context.Context) (*oauth2.Token, error)
+}
+
+var _ Flow = (*AuthCodeFlow)(nil)
+
+// nowFunc returns the current time. Tests can replace this to compute the token expiry deterministically.
+var nowFunc = time.Now
+
+// newOAuth2State returns a random string of 256 bits entropy.
+// It is encoded in base64url without padding so that it can be safely put into a URL.
 func newOAuth2State() (string, error) {
-	var n uint64
-	if err := binary.Read(rand.Reader, binary.LittleEndian, &n); err != nil {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", n), nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// httpClient returns the client if it is not nil.
+// Otherwise it returns the client in the context as oauth2.HTTPClient, or defaultHTTPClient.
+func httpClient(ctx context.Context, client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return defaultHTTPClient
+}
+
+// defaultHTTPClient sends a request via the proxy of the environment variables,
+// i.e. HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+// This sets the proxy explicitly, so that it does not depend on the default transport.
+var defaultHTTPClient = &http.Client{Transport: newDefaultTransport()}
+
+func newDefaultTransport() *http.Transport {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = t.Clone()
+		t.Proxy = http.ProxyFromEnvironment
+		return t
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
+}
+
+// durationOrDefault returns the duration if it is not zero, or the default.
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// sentinelError represents an error with the corresponding sentinel error.
+// Both of the sentinel error and the cause can be checked by errors.Is().
+type sentinelError struct {
+	sentinel error
+	cause    error
+}
+
+func (e *sentinelError) Error() string        { return fmt.Sprintf("%s (%s)", e.sentinel, e.cause) }
+func (e *sentinelError) Unwrap() error        { return e.cause }
+func (e *sentinelError) Is(target error) bool { return target == e.sentinel }
+
+func containsString(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,17 @@
+package oauth2cli
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultHTTPClient_Proxy(t *testing.T) {
+	transport, ok := defaultHTTPClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Transport wants *http.Transport but %T", defaultHTTPClient.Transport)
+	}
+	if transport.Proxy == nil || reflect.ValueOf(transport.Proxy).Pointer() != reflect.ValueOf(http.ProxyFromEnvironment).Pointer() {
+		t.Errorf("Proxy wants http.ProxyFromEnvironment")
+	}
+}
@@ -0,0 +1,133 @@
+// Package oauth2clitest provides a fake provider and browser for testing code which uses oauth2cli.
+package oauth2clitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// Provider represents the behavior of a fake provider.
+type Provider struct {
+	AuthCode     string // Code in the authorization response. Default to "AUTH_CODE".
+	AccessToken  string // Access token in the token response. Default to "ACCESS_TOKEN".
+	RefreshToken string // Refresh token in the token response. Omitted if empty.
+	ExpiresIn    int    // Lifetime of the access token in seconds. Omitted if zero.
+}
+
+// Server is a fake provider which serves the authorization endpoint and the token endpoint.
+type Server struct {
+	Endpoint oauth2.Endpoint // Endpoint of the fake provider.
+
+	provider Provider
+	server   *httptest.Server
+	mu       sync.Mutex
+	state    string
+}
+
+// NewServer starts a fake provider.
+// You need to call Close() after the test.
+func NewServer(p Provider) *Server {
+	if p.AuthCode == "" {
+		p.AuthCode = "AUTH_CODE"
+	}
+	if p.AccessToken == "" {
+		p.AccessToken = "ACCESS_TOKEN"
+	}
+	s := &Server{provider: p}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Endpoint = oauth2.Endpoint{
+		AuthURL:  s.server.URL + "/auth",
+		TokenURL: s.server.URL + "/token",
+	}
+	return s
+}
+
+// Close stops the fake provider.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// State returns the state parameter received in the last authorization request.
+func (s *Server) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/auth":
+		q := r.URL.Query()
+		s.mu.Lock()
+		s.state = q.Get("state")
+		s.mu.Unlock()
+		to, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid redirect_uri: %s", err), 400)
+			return
+		}
+		v := to.Query()
+		v.Set("code", s.provider.AuthCode)
+		v.Set("state", q.Get("state"))
+		to.RawQuery = v.Encode()
+		http.Redirect(w, r, to.String(), 302)
+
+	case r.Method == "POST" && r.URL.Path == "/token":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse form: %s", err), 400)
+			return
+		}
+		if r.Form.Get("code") != s.provider.AuthCode {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type"`
+			RefreshToken string `json:"refresh_token,omitempty"`
+			ExpiresIn    int    `json:"expires_in,omitempty"`
+		}{
+			AccessToken:  s.provider.AccessToken,
+			TokenType:    "Bearer",
+			RefreshToken: s.provider.RefreshToken,
+			ExpiresIn:    s.provider.ExpiresIn,
+		})
+
+	default:
+		http.Error(w, "Not Found", 404)
+	}
+}
+
+// OpenBrowser simulates a browser which navigates to the URL and follows the redirects.
+// It returns an error if the final response is not 200.
+func OpenBrowser(url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("Could not send a request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("StatusCode wants 200 but %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Browser returns a function which can be set to AuthCodeFlow.ShowLocalServerURL.
+// It opens the URL by OpenBrowser and reports an error to t.
+func Browser(t testing.TB) func(url string) {
+	return func(url string) {
+		if err := OpenBrowser(url); err != nil {
+			t.Errorf("Could not open the browser request: %s", err)
+		}
+	}
+}
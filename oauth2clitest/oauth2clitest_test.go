@@ -0,0 +1,44 @@
+package oauth2clitest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/int128/oauth2cli"
+	"github.com/int128/oauth2cli/oauth2clitest"
+	"golang.org/x/oauth2"
+)
+
+func TestServer(t *testing.T) {
+	s := oauth2clitest.NewServer(oauth2clitest.Provider{
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+	})
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	flow := oauth2cli.AuthCodeFlow{
+		Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     s.Endpoint,
+		},
+		State:              "STATE",
+		SkipOpenBrowser:    true,
+		ShowLocalServerURL: oauth2clitest.Browser(t),
+	}
+	token, err := flow.GetToken(ctx)
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+	if token.RefreshToken != "REFRESH_TOKEN" {
+		t.Errorf("RefreshToken wants REFRESH_TOKEN but %s", token.RefreshToken)
+	}
+	if s.State() != "STATE" {
+		t.Errorf("State wants STATE but %s", s.State())
+	}
+}
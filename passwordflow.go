@@ -0,0 +1,79 @@
+package oauth2cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// PasswordFlow provides flow with OAuth 2.0 Resource Owner Password Credentials Grant.
+// This is for an automation account of a provider which supports only this grant.
+// See https://tools.ietf.org/html/rfc6749#section-4.3
+type PasswordFlow struct {
+	ClientSettings
+
+	Username string // Required.
+	Password string // If this is empty, ReadPassword is called.
+
+	// Called with the username to read the password if Password is empty.
+	// You can read it from a terminal with hidden input, e.g. golang.org/x/term.ReadPassword.
+	// This package does not provide a terminal reader, so that it does not depend on golang.org/x/term.
+	// Default to none, i.e. an error is returned if Password is empty.
+	ReadPassword func(username string) (string, error)
+}
+
+var _ Flow = (*PasswordFlow)(nil)
+
+// GetToken sends a token request of the password grant and returns a token got from the provider.
+func (f *PasswordFlow) GetToken(ctx context.Context) (*oauth2.Token, error) {
+	r, err := f.GetTokenResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// GetTokenResult is same as GetToken but returns the result. See ClientSettings.
+func (f *PasswordFlow) GetTokenResult(ctx context.Context) (*Result, error) {
+	if err := checkTokenURL(f.Config.Endpoint.TokenURL); err != nil {
+		return nil, err
+	}
+	if f.Username == "" {
+		return nil, errors.New("Username is required")
+	}
+	password, err := f.password()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{
+		"grant_type": {"password"},
+		"username":   {f.Username},
+		"password":   {password},
+	}
+	if len(f.Config.Scopes) > 0 {
+		v.Set("scope", strings.Join(f.Config.Scopes, " "))
+	}
+	tr, err := f.exchange(ctx, httpClient(ctx, f.HTTPClient), v)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get a token: %w", wrapTokenError(err))
+	}
+	return newResult(tr, "", ""), nil
+}
+
+func (f *PasswordFlow) password() (string, error) {
+	if f.Password != "" {
+		return f.Password, nil
+	}
+	if f.ReadPassword == nil {
+		return "", errors.New("Password or ReadPassword is required")
+	}
+	password, err := f.ReadPassword(f.Username)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the password: %w", err)
+	}
+	return password, nil
+}
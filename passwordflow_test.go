@@ -0,0 +1,65 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestPasswordFlow_GetToken(t *testing.T) {
+	h := authServerHandler{
+		AccessToken:  "ACCESS_TOKEN",
+		RefreshToken: "REFRESH_TOKEN",
+		GrantType:    "password",
+		TokenParams:  url.Values{"username": {"USER"}, "password": {"PASS"}},
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	var readFor string
+	f := &oauth2cli.PasswordFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     oauth2.Endpoint{TokenURL: s.URL + "/token"},
+		}},
+		Username: "USER",
+		ReadPassword: func(username string) (string, error) {
+			readFor = username
+			return "PASS", nil
+		},
+	}
+	token, err := f.GetToken(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+	if token.RefreshToken != "REFRESH_TOKEN" {
+		t.Errorf("RefreshToken wants REFRESH_TOKEN but %s", token.RefreshToken)
+	}
+	if readFor != "USER" {
+		t.Errorf("ReadPassword wants to be called with USER but %q", readFor)
+	}
+	requests := h.ReceivedRequests("/token")
+	if len(requests) != 1 {
+		t.Fatalf("token requests wants 1 but %d", len(requests))
+	}
+	if w, g := "YOUR_CLIENT_ID:YOUR_CLIENT_SECRET", requests[0].BasicAuth; w != g {
+		t.Errorf("Basic auth wants %s but %s", w, g)
+	}
+}
+
+func TestPasswordFlow_GetToken_NoPassword(t *testing.T) {
+	f := &oauth2cli.PasswordFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "https://example.com/token"}}},
+		Username:       "USER",
+	}
+	if _, err := f.GetToken(context.Background()); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
@@ -0,0 +1,91 @@
+package oauth2cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// RefreshFlow provides flow to refresh a token by the refresh token.
+// See https://tools.ietf.org/html/rfc6749#section-6
+type RefreshFlow struct {
+	ClientSettings
+
+	// Token previously obtained from the provider, e.g. by AuthCodeFlow.
+	// It must have the refresh token.
+	Token *oauth2.Token
+}
+
+var _ Flow = (*RefreshFlow)(nil)
+
+// GetToken sends a token request of the refresh_token grant and returns a new token got from the provider.
+// If the response does not contain a refresh token, the current one is kept in the new token.
+func (f *RefreshFlow) GetToken(ctx context.Context) (*oauth2.Token, error) {
+	r, err := f.GetTokenResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Token, nil
+}
+
+// GetTokenResult is same as GetToken but returns the result. See ClientSettings.
+func (f *RefreshFlow) GetTokenResult(ctx context.Context) (*Result, error) {
+	if f.Token == nil || f.Token.RefreshToken == "" {
+		return nil, errors.New("Token does not have the refresh token")
+	}
+	return f.refresh(ctx, f.Token.RefreshToken)
+}
+
+func (f *RefreshFlow) refresh(ctx context.Context, refreshToken string) (*Result, error) {
+	if err := checkTokenURL(f.Config.Endpoint.TokenURL); err != nil {
+		return nil, err
+	}
+	v := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	tr, err := f.exchange(ctx, httpClient(ctx, f.HTTPClient), v)
+	if err != nil {
+		return nil, fmt.Errorf("Could not refresh the token: %w", wrapTokenError(err))
+	}
+	return newResult(tr, "", ""), nil
+}
+
+// TokenSource returns a token source which returns Token until it expires,
+// and then refreshes it by the refresh token. The refreshed token is reused until it expires as well.
+// The token source is safe for concurrent use, and can be passed to oauth2.NewClient.
+//
+// The context is used for the refresh requests.
+func (f *RefreshFlow) TokenSource(ctx context.Context) oauth2.TokenSource {
+	var refreshToken string
+	if f.Token != nil {
+		refreshToken = f.Token.RefreshToken
+	}
+	return oauth2.ReuseTokenSource(f.Token, &refreshTokenSource{ctx: ctx, flow: f, refreshToken: refreshToken})
+}
+
+type refreshTokenSource struct {
+	ctx          context.Context
+	flow         *RefreshFlow
+	mu           sync.Mutex // guards refreshToken
+	refreshToken string
+}
+
+func (s *refreshTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refreshToken == "" {
+		return nil, errors.New("Token expired and does not have the refresh token")
+	}
+	r, err := s.flow.refresh(s.ctx, s.refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	// The provider may rotate the refresh token.
+	s.refreshToken = r.Token.RefreshToken
+	return r.Token, nil
+}
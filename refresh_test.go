@@ -0,0 +1,128 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestRefreshFlow_TokenSource(t *testing.T) {
+	h := authServerHandler{
+		AccessToken: "ACCESS_TOKEN_1",
+		// rotate the refresh token, and return an expired token to refresh again
+		RefreshToken: "REFRESH_TOKEN_1",
+		ExpiresIn:    1,
+		GrantType:    "refresh_token",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	f := &oauth2cli.RefreshFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{
+			ClientID:     "YOUR_CLIENT_ID",
+			ClientSecret: "YOUR_CLIENT_SECRET",
+			Endpoint:     oauth2.Endpoint{TokenURL: s.URL + "/token"},
+		}},
+		Token: &oauth2.Token{
+			AccessToken:  "ACCESS_TOKEN_0",
+			RefreshToken: "REFRESH_TOKEN_0",
+			Expiry:       time.Now().Add(-time.Hour),
+		},
+	}
+	ts := f.TokenSource(context.Background())
+	for i := 1; i <= 2; i++ {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Could not get a token: %s", err)
+		}
+		if token.AccessToken != "ACCESS_TOKEN_1" {
+			t.Errorf("AccessToken wants ACCESS_TOKEN_1 but %s", token.AccessToken)
+		}
+	}
+	var refreshTokens []string
+	for _, r := range h.ReceivedRequests("/token") {
+		refreshTokens = append(refreshTokens, r.Form.Get("refresh_token"))
+	}
+	if w, g := "[REFRESH_TOKEN_0 REFRESH_TOKEN_1]", fmt.Sprint(refreshTokens); w != g {
+		t.Errorf("refresh tokens wants %s but %s", w, g)
+	}
+}
+
+func TestRefreshFlow_TokenSource_Valid(t *testing.T) {
+	f := &oauth2cli.RefreshFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "https://example.com/token"}}},
+		Token:          &oauth2.Token{AccessToken: "ACCESS_TOKEN", Expiry: time.Now().Add(time.Hour)},
+	}
+	token, err := f.TokenSource(context.Background()).Token()
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+}
+
+func TestRefreshFlow_GetToken_NoRefreshToken(t *testing.T) {
+	f := &oauth2cli.RefreshFlow{
+		ClientSettings: oauth2cli.ClientSettings{Config: oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "https://example.com/token"}}},
+		Token:          &oauth2.Token{AccessToken: "ACCESS_TOKEN"},
+	}
+	if _, err := f.GetToken(context.Background()); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestRefreshFlow_GetToken_ClientAssertion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	h := authServerHandler{
+		AccessToken: "ACCESS_TOKEN",
+		GrantType:   "refresh_token",
+	}
+	s := httptest.NewServer(&h)
+	defer s.Close()
+	f := &oauth2cli.RefreshFlow{
+		ClientSettings: oauth2cli.ClientSettings{
+			Config: oauth2.Config{
+				ClientID:     "YOUR_CLIENT_ID",
+				ClientSecret: "YOUR_CLIENT_SECRET",
+				Endpoint:     oauth2.Endpoint{TokenURL: s.URL + "/token"},
+			},
+			ClientAssertion: &oauth2cli.ClientAssertion{Key: key},
+		},
+		Token: &oauth2.Token{RefreshToken: "REFRESH_TOKEN"},
+	}
+	token, err := f.GetToken(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get a token: %s", err)
+	}
+	if token.AccessToken != "ACCESS_TOKEN" {
+		t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+	}
+	requests := h.ReceivedRequests("/token")
+	if len(requests) != 1 {
+		t.Fatalf("token requests wants 1 but %d", len(requests))
+	}
+	r := requests[0]
+	if r.BasicAuth != "" {
+		t.Errorf("Basic auth wants none but %s", r.BasicAuth)
+	}
+	if w, g := "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", r.Form.Get("client_assertion_type"); w != g {
+		t.Errorf("client_assertion_type wants %s but %s", w, g)
+	}
+	if r.Form.Get("client_assertion") == "" {
+		t.Errorf("client_assertion wants non-empty but empty")
+	}
+	if r.Form.Get("client_secret") != "" {
+		t.Errorf("client_secret wants empty but %s", r.Form.Get("client_secret"))
+	}
+}
@@ -0,0 +1,71 @@
+package oauth2cli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Result represents a result of the flow.
+type Result struct {
+	Token         *oauth2.Token          // Token got from the provider.
+	GrantedScopes []string               // Scopes in the token response. Nil if the provider granted the requested scopes as-is.
+	State         string                 // State parameter of the authorization request.
+	Nonce         string                 // Nonce parameter of the authorization request. Empty if it was not sent.
+	Raw           map[string]interface{} // All members of the token response.
+	RawBody       []byte                 // Body of the token response as-is, e.g. to decode a large number or a member which Raw does not keep.
+	ObtainedAt    time.Time              // Local time when the token response was received. Token.Expiry is relative to this.
+
+	// ID token in the token response, or the authorization response of a hybrid flow.
+	// IDTokenClaims is decoded from the payload without verification of the signature,
+	// and it is nil if the ID token could not be decoded.
+	IDToken       string
+	IDTokenClaims map[string]interface{}
+
+	// Set if the flow failed. This is used only by Start, and GetTokenResult returns the error instead.
+	Err error
+}
+
+// newResult returns the result of the token response.
+// If the token response does not contain an ID token, the one of the authorization response is used.
+func newResult(tr *tokenResponse, state string, authorizationIDToken string) *Result {
+	r := &Result{
+		Token:         tr.Token,
+		GrantedScopes: GrantedScopes(tr.Token),
+		State:         state,
+		Raw:           tr.Raw,
+		RawBody:       tr.Body,
+		ObtainedAt:    tr.ObtainedAt,
+	}
+	idToken, _ := tr.Raw["id_token"].(string)
+	if idToken == "" {
+		idToken = authorizationIDToken
+	}
+	if idToken != "" {
+		r.IDToken = idToken
+		r.IDTokenClaims, _ = decodeJWTClaims(idToken)
+	}
+	return r
+}
+
+// decodeJWTClaims returns the claims in the payload of the JWT.
+// This does not verify the signature.
+func decodeJWTClaims(jwt string) (map[string]interface{}, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT must have 3 parts but %d", len(parts))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode the payload of JWT: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("Could not parse the payload of JWT: %w", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,513 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// AuthStyle represents how the client credentials are sent in a token request.
+type AuthStyle int
+
+// Styles of the client credentials in a token request.
+const (
+	// Send the client credentials in the style which the provider accepts. This is the default.
+	// The form is used for a provider known to reject Basic authentication, the same as golang.org/x/oauth2.
+	// Otherwise AuthStyleInHeader is tried first, and then AuthStyleInParams if the provider rejects the request with 400 or 401,
+	// unless the error is of the grant, e.g. invalid_grant.
+	// The detected style is stored into AuthStyleCache if it is given.
+	AuthStyleAutoDetect AuthStyle = iota
+
+	AuthStyleInHeader // Basic authentication. See https://tools.ietf.org/html/rfc6749#section-2.3.1
+	AuthStyleInParams // client_id and client_secret parameters in the form.
+
+	authStyleNone // No client secret, e.g. the client assertion is in the form.
+)
+
+// AuthStyleCache stores the detected AuthStyle for each pair of token endpoint and client ID,
+// so that flows sharing it do not send a failed request to detect the style again.
+// The zero value is ready to use, and it is safe for concurrent use.
+type AuthStyleCache struct {
+	mu     sync.Mutex
+	styles map[authStyleCacheKey]AuthStyle
+}
+
+type authStyleCacheKey struct {
+	tokenURL string
+	clientID string
+}
+
+func (c *AuthStyleCache) get(config *oauth2.Config) (AuthStyle, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	style, ok := c.styles[authStyleCacheKey{config.Endpoint.TokenURL, config.ClientID}]
+	return style, ok
+}
+
+func (c *AuthStyleCache) set(config *oauth2.Config, style AuthStyle) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.styles == nil {
+		c.styles = make(map[authStyleCacheKey]AuthStyle)
+	}
+	c.styles[authStyleCacheKey{config.Endpoint.TokenURL, config.ClientID}] = style
+}
+
+// tokenExchangeAutoDetect sends a token request by the style.
+// If the style is AuthStyleAutoDetect, it uses the cached style or detects the style by the response.
+func tokenExchangeAutoDetect(ctx context.Context, client *http.Client, config *oauth2.Config, form url.Values, style AuthStyle, cache *AuthStyleCache, encoder TokenRequestEncoder) (*tokenResponse, error) {
+	if style != AuthStyleAutoDetect {
+		return tokenExchange(ctx, client, config, form, style, encoder)
+	}
+	if cached, ok := cache.get(config); ok {
+		return tokenExchange(ctx, client, config, form, cached, encoder)
+	}
+	if !providerAuthHeaderWorks(config.Endpoint.TokenURL) {
+		return tokenExchange(ctx, client, config, form, AuthStyleInParams, encoder)
+	}
+	tr, err := tokenExchange(ctx, client, config, form, AuthStyleInHeader, encoder)
+	if err == nil {
+		cache.set(config, AuthStyleInHeader)
+		return tr, nil
+	}
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) || (re.Response.StatusCode != 400 && re.Response.StatusCode != 401) {
+		return nil, err
+	}
+	if containsString(grantErrorCodes, tokenErrorCode(err)) {
+		return nil, err // the client is authenticated but the grant is rejected
+	}
+	tr, err = tokenExchange(ctx, client, config, form, AuthStyleInParams, encoder)
+	if err != nil {
+		return nil, err
+	}
+	cache.set(config, AuthStyleInParams)
+	return tr, nil
+}
+
+// grantErrorCodes are the error codes of the token response which are not caused by the client authentication.
+// The request is not sent again in the other style on these errors, e.g. on polling of DeviceCodeFlow.
+var grantErrorCodes = []string{
+	"invalid_grant",
+	"invalid_scope",
+	"unsupported_grant_type",
+	"authorization_pending",
+	"slow_down",
+	"access_denied",
+	"expired_token",
+}
+
+// brokenAuthHeaderProviders is the list of the token URL prefixes of the providers
+// which reject the client credentials in Basic authentication.
+// This is same as golang.org/x/oauth2/internal, because it is not exported.
+var brokenAuthHeaderProviders = []string{
+	"https://accounts.google.com/",
+	"https://api.codeswholesale.com/oauth/token",
+	"https://api.dropbox.com/",
+	"https://api.dropboxapi.com/",
+	"https://api.instagram.com/",
+	"https://api.netatmo.net/",
+	"https://api.odnoklassniki.ru/",
+	"https://api.pushbullet.com/",
+	"https://api.soundcloud.com/",
+	"https://api.twitch.tv/",
+	"https://id.twitch.tv/",
+	"https://app.box.com/",
+	"https://api.box.com/",
+	"https://connect.stripe.com/",
+	"https://login.mailchimp.com/",
+	"https://login.microsoftonline.com/",
+	"https://login.salesforce.com/",
+	"https://login.windows.net",
+	"https://login.live.com/",
+	"https://login.live-int.com/",
+	"https://oauth.sandbox.trainingpeaks.com/",
+	"https://oauth.trainingpeaks.com/",
+	"https://oauth.vk.com/",
+	"https://openapi.baidu.com/",
+	"https://slack.com/",
+	"https://test-sandbox.auth.corp.google.com",
+	"https://test.salesforce.com/",
+	"https://user.gini.net/",
+	"https://www.douban.com/",
+	"https://www.googleapis.com/",
+	"https://www.linkedin.com/",
+	"https://www.strava.com/oauth/",
+	"https://www.wunderlist.com/oauth/",
+	"https://api.patreon.com/",
+	"https://sandbox.codeswholesale.com/oauth/token",
+	"https://api.sipgate.com/v1/authorization/oauth",
+	"https://api.medium.com/v1/tokens",
+	"https://log.finalsurge.com/oauth/token",
+	"https://multisport.todaysplan.com.au/rest/oauth/access_token",
+	"https://whats.todaysplan.com.au/rest/oauth/access_token",
+	"https://stackoverflow.com/oauth/access_token",
+	"https://account.health.nokia.com",
+	"https://accounts.zoho.com",
+}
+
+// brokenAuthHeaderDomains is the list of the domains of the providers which issue dynamic endpoints.
+var brokenAuthHeaderDomains = []string{
+	".auth0.com",
+	".force.com",
+	".myshopify.com",
+	".okta.com",
+	".oktapreview.com",
+}
+
+// providerAuthHeaderWorks returns false if the provider is known to reject Basic authentication.
+func providerAuthHeaderWorks(tokenURL string) bool {
+	for _, s := range brokenAuthHeaderProviders {
+		if strings.HasPrefix(tokenURL, s) {
+			return false
+		}
+	}
+	if u, err := url.Parse(tokenURL); err == nil {
+		for _, s := range brokenAuthHeaderDomains {
+			if strings.HasSuffix(u.Host, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TokenRequestEncoder returns the body and content type of a token request from the parameters.
+type TokenRequestEncoder func(v url.Values) (body string, contentType string)
+
+// checkTokenURL returns an error if the token endpoint is not an absolute URL of http or https.
+func checkTokenURL(tokenURL string) error {
+	if tokenURL == "" {
+		return errors.New("Config.Endpoint.TokenURL is required")
+	}
+	u, err := url.Parse(tokenURL)
+	if err != nil {
+		return fmt.Errorf("Invalid Config.Endpoint.TokenURL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Config.Endpoint.TokenURL must be http or https but %s", tokenURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("Config.Endpoint.TokenURL must have a host but %s", tokenURL)
+	}
+	return nil
+}
+
+// tokenResponse represents a successful token response.
+type tokenResponse struct {
+	Token      *oauth2.Token
+	Raw        map[string]interface{} // All members of the response.
+	Body       []byte                 // Body of the response as-is.
+	ObtainedAt time.Time              // When the response was received. Token.Expiry is relative to this.
+}
+
+// tokenExchange sends a token request with the parameters to the token endpoint of the config,
+// and returns the token and all members of the response.
+// This is shared by all flows, so that they behave consistently, e.g. the client should be resolved by httpClient().
+//
+// This is compatible with golang.org/x/oauth2, i.e. it returns *oauth2.RetrieveError on a non-2xx response,
+// and it sends Accept: application/json so that a provider returns JSON rather than form-encoded.
+// Both JSON and form-encoded responses are accepted.
+//
+// The body is encoded by encoder if it is not nil, or the standard form encoding.
+func tokenExchange(ctx context.Context, client *http.Client, config *oauth2.Config, form url.Values, style AuthStyle, encoder TokenRequestEncoder) (*tokenResponse, error) {
+	v := url.Values{}
+	for key, values := range form {
+		v[key] = values
+	}
+	if style == AuthStyleInParams {
+		v.Set("client_id", config.ClientID)
+		if config.ClientSecret != "" {
+			v.Set("client_secret", config.ClientSecret)
+		}
+	}
+	reqBody, contentType := v.Encode(), "application/x-www-form-urlencoded"
+	if encoder != nil {
+		reqBody, contentType = encoder(v)
+	}
+	req, err := http.NewRequest("POST", config.Endpoint.TokenURL, strings.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if style == AuthStyleInHeader {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	obtainedAt := nowFunc()
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the token response: %w", err)
+	}
+	if code := resp.StatusCode; code < 200 || code > 299 {
+		return nil, &oauth2.RetrieveError{Response: resp, Body: body}
+	}
+	token, raw, err := parseTokenResponse(resp.Header.Get("Content-Type"), body, obtainedAt)
+	if err != nil {
+		return nil, unexpectedTokenResponse(resp, body, err)
+	}
+	// Keep the refresh token if the response of a refresh request does not contain it.
+	if token.RefreshToken == "" {
+		token.RefreshToken = v.Get("refresh_token")
+	}
+	if token.AccessToken == "" {
+		return nil, unexpectedTokenResponse(resp, body, errors.New("Token response does not contain access_token"))
+	}
+	return &tokenResponse{Token: token, Raw: raw, Body: body, ObtainedAt: obtainedAt}, nil
+}
+
+// maxBodySnippet is the max length of the body in an error message.
+const maxBodySnippet = 256
+
+// unexpectedTokenResponse returns an error with the status, content type and beginning of the body,
+// e.g. for an HTML page of a captive portal.
+func unexpectedTokenResponse(resp *http.Response, body []byte, err error) error {
+	snippet := string(body)
+	if len(snippet) > maxBodySnippet {
+		snippet = snippet[:maxBodySnippet] + "..."
+	}
+	return fmt.Errorf("Unexpected token response (%s, content-type %s): %w\n%s",
+		resp.Status, resp.Header.Get("Content-Type"), err, snippet)
+}
+
+// parseTokenResponse parses the body of a token response in JSON or form-encoded.
+// All members of the response are returned as raw, and available via Token.Extra() as well.
+// A member of a form-encoded response is a string.
+// Token.Expiry is computed from expires_in relative to obtainedAt.
+func parseTokenResponse(contentType string, body []byte, obtainedAt time.Time) (*oauth2.Token, map[string]interface{}, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "text/plain":
+		vals, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse the token response: %w", err)
+		}
+		token := &oauth2.Token{
+			AccessToken:  vals.Get("access_token"),
+			TokenType:    vals.Get("token_type"),
+			RefreshToken: vals.Get("refresh_token"),
+		}
+		e := vals.Get("expires_in")
+		if e == "" {
+			e = vals.Get("expires") // broken Facebook spelling of expires_in
+		}
+		if expires, _ := strconv.Atoi(e); expires != 0 {
+			token.Expiry = obtainedAt.Add(time.Duration(expires) * time.Second)
+		}
+		raw := make(map[string]interface{})
+		for key := range vals {
+			raw[key] = vals.Get(key)
+		}
+		omitEmptyIDToken(raw)
+		return token.WithExtra(raw), raw, nil
+	default:
+		var tj tokenJSON
+		if err := json.Unmarshal(body, &tj); err != nil {
+			return nil, nil, fmt.Errorf("Could not parse the token response: %w", err)
+		}
+		raw := make(map[string]interface{})
+		json.Unmarshal(body, &raw) // no error checks for optional fields
+		omitEmptyIDToken(raw)
+		token := &oauth2.Token{
+			AccessToken:  tj.AccessToken,
+			TokenType:    tj.TokenType,
+			RefreshToken: tj.RefreshToken,
+			Expiry:       tj.expiry(obtainedAt),
+		}
+		return token.WithExtra(raw), raw, nil
+	}
+}
+
+// omitEmptyIDToken removes an empty id_token from the members of the token response.
+// Some providers return "id_token": "" if the openid scope is not requested,
+// and it should be treated as absent rather than an invalid JWT.
+func omitEmptyIDToken(raw map[string]interface{}) {
+	if v, ok := raw["id_token"]; ok && (v == nil || v == "") {
+		delete(raw, "id_token")
+	}
+}
+
+// tokenJSON represents a token response in JSON.
+// See https://tools.ietf.org/html/rfc6749#section-5.1
+type tokenJSON struct {
+	AccessToken  string         `json:"access_token"`
+	TokenType    string         `json:"token_type"`
+	RefreshToken string         `json:"refresh_token"`
+	ExpiresIn    expirationTime `json:"expires_in"` // some providers return a string instead of a number
+	Expires      expirationTime `json:"expires"`    // broken Facebook spelling of expires_in
+}
+
+func (e *tokenJSON) expiry(obtainedAt time.Time) time.Time {
+	if v := e.ExpiresIn; v != 0 {
+		return obtainedAt.Add(time.Duration(v) * time.Second)
+	}
+	if v := e.Expires; v != 0 {
+		return obtainedAt.Add(time.Duration(v) * time.Second)
+	}
+	return time.Time{}
+}
+
+// expirationTime is a number of seconds in a number or string.
+type expirationTime int32
+
+func (e *expirationTime) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return err
+	}
+	*e = expirationTime(i)
+	return nil
+}
+
+// GrantedScopes returns the scopes in the token response.
+// The provider may grant scopes different from the requested ones.
+//
+// This returns nil if the token response does not contain the scope,
+// which means the provider granted the requested scopes as-is.
+// See https://tools.ietf.org/html/rfc6749#section-5.1
+func GrantedScopes(token *oauth2.Token) []string {
+	scope, ok := token.Extra("scope").(string)
+	if !ok || scope == "" {
+		return nil
+	}
+	return strings.Fields(scope)
+}
+
+// newTokenResponseLogMessage returns a summary of the token response without secret values.
+func newTokenResponseLogMessage(token *oauth2.Token, raw map[string]interface{}) LogMessage {
+	fields := map[string]string{
+		"token_type":    token.TokenType,
+		"access_token":  redactToken(token.AccessToken),
+		"refresh_token": redactToken(token.RefreshToken),
+		"id_token":      strconv.FormatBool(raw["id_token"] != nil),
+		"scope":         strings.Join(GrantedScopes(token), " "),
+	}
+	if v, ok := raw["expires_in"]; ok {
+		fields["expires_in"] = fmt.Sprintf("%v", v)
+	}
+	return LogMessage{
+		Event: "token_received",
+		Message: fmt.Sprintf("Got a token response: token_type=%s, expires_in=%s, scope=%s, access_token=%s, refresh_token=%s, id_token=%s",
+			fields["token_type"], fields["expires_in"], fields["scope"], fields["access_token"], fields["refresh_token"], fields["id_token"]),
+		Fields: fields,
+	}
+}
+
+// redactToken returns the length and the last 4 characters of the token.
+// A token shorter than 16 characters is redacted to the length only.
+func redactToken(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	if len(s) < 16 {
+		return fmt.Sprintf("(%d chars)", len(s))
+	}
+	return fmt.Sprintf("(%d chars, ...%s)", len(s), s[len(s)-4:])
+}
+
+// normalizeTokenType sets the canonical form "Bearer" to the token type if it is bearer in any case.
+// Providers return the token type inconsistently, e.g. bearer or BEARER.
+// The original value is kept in the raw fields of the token.
+func normalizeTokenType(token *oauth2.Token) {
+	if strings.EqualFold(token.TokenType, "bearer") {
+		token.TokenType = "Bearer"
+	}
+}
+
+// wrapTokenError adds the WWW-Authenticate header of the token response to the error.
+// It helps to distinguish an error of a gateway without body from an error of the provider.
+// The original *oauth2.RetrieveError is available via errors.As.
+func wrapTokenError(err error) error {
+	var rErr *oauth2.RetrieveError
+	if !errors.As(err, &rErr) || rErr.Response == nil {
+		return err
+	}
+	if v := rErr.Response.Header.Get("WWW-Authenticate"); v != "" {
+		return fmt.Errorf("%w\nWWW-Authenticate: %s", err, v)
+	}
+	return err
+}
+
+// tokenErrorCode returns the error code of the token error response, or empty if it is not available.
+// See https://tools.ietf.org/html/rfc6749#section-5.2
+func tokenErrorCode(err error) string {
+	var rErr *oauth2.RetrieveError
+	if !errors.As(err, &rErr) {
+		return ""
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(rErr.Body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	// form-encoded error response of a non-conformant provider
+	if vals, err := url.ParseQuery(string(rErr.Body)); err == nil {
+		return vals.Get("error")
+	}
+	return ""
+}
+
+// maxRetryAfter is the max delay of Retry-After header which is honored.
+const maxRetryAfter = 1 * time.Minute
+
+// retryDelay returns the delay before retrying the token request, or false if the error is not transient.
+// The error is transient if the response status is 429 or 5xx.
+// If the response has Retry-After header, it is used instead of the backoff.
+// It returns false if Retry-After exceeds maxRetryAfter, so that the flow does not stall for a long time.
+func retryDelay(err error, backoff time.Duration) (time.Duration, bool) {
+	var rErr *oauth2.RetrieveError
+	if !errors.As(err, &rErr) || rErr.Response == nil {
+		return 0, false
+	}
+	code := rErr.Response.StatusCode
+	if code != http.StatusTooManyRequests && code < 500 {
+		return 0, false
+	}
+	retryAfter := rErr.Response.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return backoff, true
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		delay = time.Until(t)
+	} else {
+		return backoff, true
+	}
+	if delay > maxRetryAfter {
+		return 0, false
+	}
+	return delay, true
+}
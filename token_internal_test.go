@@ -0,0 +1,304 @@
+package oauth2cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestParseTokenResponse_Expiry(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"JSON", "application/json", `{"access_token":"ACCESS_TOKEN","expires_in":3600}`},
+		{"JSON/String", "application/json", `{"access_token":"ACCESS_TOKEN","expires_in":"3600"}`},
+		{"JSON/Facebook", "application/json", `{"access_token":"ACCESS_TOKEN","expires":3600}`},
+		{"Form", "application/x-www-form-urlencoded", `access_token=ACCESS_TOKEN&expires_in=3600`},
+		{"Form/Facebook", "text/plain", `access_token=ACCESS_TOKEN&expires=3600`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			obtainedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			token, _, err := parseTokenResponse(c.contentType, []byte(c.body), obtainedAt)
+			if err != nil {
+				t.Fatalf("Could not parse the token response: %s", err)
+			}
+			if token.AccessToken != "ACCESS_TOKEN" {
+				t.Errorf("AccessToken wants ACCESS_TOKEN but %s", token.AccessToken)
+			}
+			if want := obtainedAt.Add(time.Hour); !token.Expiry.Equal(want) {
+				t.Errorf("Expiry wants %s but %s", want, token.Expiry)
+			}
+		})
+	}
+}
+
+func TestParseTokenResponse_NoExpiry(t *testing.T) {
+	token, _, err := parseTokenResponse("application/json", []byte(`{"access_token":"ACCESS_TOKEN"}`), time.Now())
+	if err != nil {
+		t.Fatalf("Could not parse the token response: %s", err)
+	}
+	if !token.Expiry.IsZero() {
+		t.Errorf("Expiry wants zero but %s", token.Expiry)
+	}
+}
+
+func TestTokenExchange_AuthStyle(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		style      AuthStyle
+		wantHeader bool
+	}{
+		{"InHeader", AuthStyleInHeader, true},
+		{"InParams", AuthStyleInParams, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("Could not parse form: %s", err)
+				}
+				id, secret, ok := r.BasicAuth()
+				if c.wantHeader {
+					if !ok || id != "YOUR_CLIENT_ID" || secret != "YOUR_CLIENT_SECRET" {
+						t.Errorf("basic auth wants the client credentials but %v, %s, %s", ok, id, secret)
+					}
+					if r.PostForm.Get("client_secret") != "" {
+						t.Errorf("client_secret wants empty but %s", r.PostForm.Get("client_secret"))
+					}
+				} else {
+					if ok {
+						t.Errorf("basic auth wants none but %s", id)
+					}
+					if r.PostForm.Get("client_id") != "YOUR_CLIENT_ID" || r.PostForm.Get("client_secret") != "YOUR_CLIENT_SECRET" {
+						t.Errorf("form wants the client credentials but %v", r.PostForm)
+					}
+				}
+				if r.PostForm.Get("grant_type") != "client_credentials" {
+					t.Errorf("grant_type wants client_credentials but %s", r.PostForm.Get("grant_type"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"access_token":"ACCESS_TOKEN","token_type":"Bearer"}`)
+			}))
+			defer s.Close()
+			config := &oauth2.Config{
+				ClientID:     "YOUR_CLIENT_ID",
+				ClientSecret: "YOUR_CLIENT_SECRET",
+				Endpoint:     oauth2.Endpoint{TokenURL: s.URL},
+			}
+			form := url.Values{"grant_type": {"client_credentials"}}
+			tr, err := tokenExchange(context.Background(), http.DefaultClient, config, form, c.style, nil)
+			if err != nil {
+				t.Fatalf("Could not exchange token: %s", err)
+			}
+			if tr.Token.AccessToken != "ACCESS_TOKEN" || tr.Raw["access_token"] != "ACCESS_TOKEN" {
+				t.Errorf("AccessToken wants ACCESS_TOKEN but %s, %v", tr.Token.AccessToken, tr.Raw)
+			}
+			if form.Get("client_id") != "" {
+				t.Errorf("form wants not to be modified but %v", form)
+			}
+		})
+	}
+}
+
+func TestTokenExchange_UnexpectedResponse(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body>Sign in to the Wi-Fi network</body></html>`)
+	}))
+	defer s.Close()
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: s.URL}}
+	_, err := tokenExchange(context.Background(), http.DefaultClient, config, url.Values{}, AuthStyleInHeader, nil)
+	if err == nil {
+		t.Fatalf("err wants non-nil but nil")
+	}
+	for _, want := range []string{"Unexpected token response", "200 OK", "content-type text/html", "Sign in to the Wi-Fi network"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err wants to contain %q but %s", want, err)
+		}
+	}
+}
+
+func TestTokenExchange_Encoder(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Could not read the body: %s", err)
+		}
+		if want := "grant_type=authorization_code&code=A/B"; string(b) != want {
+			t.Errorf("body wants %s but %s", want, string(b))
+		}
+		if want := "application/x-www-form-urlencoded; charset=utf-8"; r.Header.Get("Content-Type") != want {
+			t.Errorf("Content-Type wants %s but %s", want, r.Header.Get("Content-Type"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"ACCESS_TOKEN","token_type":"Bearer"}`)
+	}))
+	defer s.Close()
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: s.URL}}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {"A/B"}}
+	encoder := func(v url.Values) (string, string) {
+		body := "grant_type=" + v.Get("grant_type") + "&code=" + v.Get("code")
+		return body, "application/x-www-form-urlencoded; charset=utf-8"
+	}
+	if _, err := tokenExchange(context.Background(), http.DefaultClient, config, form, AuthStyleInHeader, encoder); err != nil {
+		t.Fatalf("Could not exchange token: %s", err)
+	}
+}
+
+func TestNewTokenResponseLogMessage(t *testing.T) {
+	token, raw, err := parseTokenResponse("application/json", []byte(`{
+		"access_token": "ACCESS_TOKEN_0123456789abcd",
+		"refresh_token": "SHORT",
+		"id_token": "ID_TOKEN_SECRET",
+		"token_type": "Bearer",
+		"expires_in": 3600,
+		"scope": "openid email"
+	}`), time.Now())
+	if err != nil {
+		t.Fatalf("Could not parse the token response: %s", err)
+	}
+	m := newTokenResponseLogMessage(token, raw)
+	want := map[string]string{
+		"token_type":    "Bearer",
+		"access_token":  "(27 chars, ...abcd)",
+		"refresh_token": "(5 chars)",
+		"id_token":      "true",
+		"scope":         "openid email",
+		"expires_in":    "3600",
+	}
+	for k, v := range want {
+		if m.Fields[k] != v {
+			t.Errorf("Fields[%s] wants %s but %s", k, v, m.Fields[k])
+		}
+	}
+	for _, secret := range []string{"ACCESS_TOKEN", "SHORT", "ID_TOKEN_SECRET"} {
+		if strings.Contains(m.Message, secret) {
+			t.Errorf("Message must not contain %s: %s", secret, m.Message)
+		}
+	}
+}
+
+func TestTokenExchange_Expiry(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"ACCESS_TOKEN","expires_in":3600}`)
+	}))
+	defer s.Close()
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: s.URL}}
+	tr, err := tokenExchange(context.Background(), http.DefaultClient, config, url.Values{}, AuthStyleInHeader, nil)
+	if err != nil {
+		t.Fatalf("Could not exchange token: %s", err)
+	}
+	if !tr.ObtainedAt.Equal(now) {
+		t.Errorf("ObtainedAt wants %s but %s", now, tr.ObtainedAt)
+	}
+	if want := now.Add(time.Hour); !tr.Token.Expiry.Equal(want) {
+		t.Errorf("Expiry wants %s but %s", want, tr.Token.Expiry)
+	}
+}
+
+func TestTokenExchangeAutoDetect(t *testing.T) {
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Could not parse form: %s", err)
+		}
+		// this provider accepts only the client secret in the form
+		if _, _, ok := r.BasicAuth(); ok || r.PostForm.Get("client_secret") != "YOUR_CLIENT_SECRET" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(401)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"ACCESS_TOKEN"}`)
+	}))
+	defer s.Close()
+	config := &oauth2.Config{
+		ClientID:     "YOUR_CLIENT_ID",
+		ClientSecret: "YOUR_CLIENT_SECRET",
+		Endpoint:     oauth2.Endpoint{TokenURL: s.URL},
+	}
+	var cache AuthStyleCache
+	for _, c := range []struct {
+		name         string
+		style        AuthStyle
+		wantRequests int
+	}{
+		{"Detect", AuthStyleAutoDetect, 2},
+		{"Cached", AuthStyleAutoDetect, 1},
+		{"Explicit", AuthStyleInParams, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			requests = 0
+			tr, err := tokenExchangeAutoDetect(context.Background(), http.DefaultClient, config, url.Values{}, c.style, &cache, nil)
+			if err != nil {
+				t.Fatalf("Could not exchange token: %s", err)
+			}
+			if tr.Token.AccessToken != "ACCESS_TOKEN" {
+				t.Errorf("AccessToken wants ACCESS_TOKEN but %s", tr.Token.AccessToken)
+			}
+			if requests != c.wantRequests {
+				t.Errorf("requests wants %d but %d", c.wantRequests, requests)
+			}
+		})
+	}
+	if style, ok := cache.get(config); !ok || style != AuthStyleInParams {
+		t.Errorf("cache wants AuthStyleInParams but %v, %v", style, ok)
+	}
+}
+
+func TestProviderAuthHeaderWorks(t *testing.T) {
+	for tokenURL, want := range map[string]bool{
+		"https://accounts.google.com/o/oauth2/token":                                false,
+		"https://login.microsoftonline.com/common/oauth2/v2.0/token":                false,
+		"https://slack.com/api/oauth.access":                                        false,
+		"https://example.okta.com/oauth2/v1/token":                                  false,
+		"https://github.com/login/oauth/access_token":                               true,
+		"https://keycloak.example.com/realms/example/protocol/openid-connect/token": true,
+	} {
+		if got := providerAuthHeaderWorks(tokenURL); got != want {
+			t.Errorf("providerAuthHeaderWorks(%s) wants %v but %v", tokenURL, want, got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		status     int
+		retryAfter string
+		wantDelay  time.Duration
+		wantOK     bool
+	}{
+		{"Backoff", 503, "", time.Second, true},
+		{"RetryAfter", 429, "3", 3 * time.Second, true},
+		{"RetryAfterTooLong", 503, "86400", 0, false},
+		{"RetryAfterDateTooLong", 503, time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), 0, false},
+		{"NotTransient", 400, "", 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+			if c.retryAfter != "" {
+				resp.Header.Set("Retry-After", c.retryAfter)
+			}
+			delay, ok := retryDelay(&oauth2.RetrieveError{Response: resp}, time.Second)
+			if delay != c.wantDelay || ok != c.wantOK {
+				t.Errorf("retryDelay wants %s, %v but %s, %v", c.wantDelay, c.wantOK, delay, ok)
+			}
+		})
+	}
+}
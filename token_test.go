@@ -0,0 +1,26 @@
+package oauth2cli_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	for _, c := range []struct {
+		extra map[string]interface{}
+		want  []string
+	}{
+		{map[string]interface{}{"scope": "email profile"}, []string{"email", "profile"}},
+		{map[string]interface{}{"scope": ""}, nil},
+		{map[string]interface{}{}, nil},
+	} {
+		token := (&oauth2.Token{AccessToken: "ACCESS_TOKEN"}).WithExtra(c.extra)
+		got := oauth2cli.GrantedScopes(token)
+		if !reflect.DeepEqual(c.want, got) {
+			t.Errorf("GrantedScopes(%v) wants %v but %v", c.extra, c.want, got)
+		}
+	}
+}
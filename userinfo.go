@@ -0,0 +1,104 @@
+package oauth2cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// UserInfo represents the claims of the userinfo response.
+// See https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+type UserInfo struct {
+	Subject       string // sub claim.
+	Email         string // email claim. Empty if the provider did not return it.
+	EmailVerified bool   // email_verified claim.
+	Name          string // name claim. Empty if the provider did not return it.
+
+	Claims map[string]interface{} // All claims of the response.
+}
+
+// FetchUserInfo sends a request with the access token to the userinfo endpoint and returns the claims.
+// The endpoint is available by Discover, i.e. ProviderMetadata.UserinfoEndpoint.
+// See https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+//
+// A signed response (application/jwt) is decoded without verification of the signature,
+// because it is received from the provider over TLS.
+//
+// The request is sent via the default client of ClientSettings.HTTPClient.
+//
+// This does not check sub claim against the ID token.
+// Use FetchUserInfoWithOptions with UserInfoOptions.Subject to prevent the token substitution.
+func FetchUserInfo(ctx context.Context, userinfoEndpoint string, token *oauth2.Token) (*UserInfo, error) {
+	return FetchUserInfoWithOptions(ctx, userinfoEndpoint, token, UserInfoOptions{})
+}
+
+// UserInfoOptions represents the options of the userinfo request.
+type UserInfoOptions struct {
+	// sub claim of the ID token, e.g. Result.IDTokenClaims["sub"].
+	// If this is set, sub claim of the userinfo response must be identical to it.
+	// See https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+	Subject string
+
+	// HTTP client used for the userinfo request.
+	// Default to the same client as ClientSettings.HTTPClient.
+	HTTPClient *http.Client
+}
+
+// FetchUserInfoWithOptions is same as FetchUserInfo but the request is sent with the options.
+// It returns an error if UserInfoOptions.Subject is set and sub claim of the response does not match.
+func FetchUserInfoWithOptions(ctx context.Context, userinfoEndpoint string, token *oauth2.Token, o UserInfoOptions) (*UserInfo, error) {
+	if token == nil || token.AccessToken == "" {
+		return nil, errors.New("Access token is required")
+	}
+	req, err := http.NewRequest("GET", userinfoEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid userinfo endpoint %s: %w", userinfoEndpoint, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	token.SetAuthHeader(req)
+	resp, err := httpClient(ctx, o.HTTPClient).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the userinfo: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the userinfo response: %w", err)
+	}
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("Could not get the userinfo from %s: %s", userinfoEndpoint, resp.Status)
+		if v := resp.Header.Get("WWW-Authenticate"); v != "" {
+			return nil, fmt.Errorf("%w\nWWW-Authenticate: %s", err, v)
+		}
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/jwt" {
+		claims, err = decodeJWTClaims(strings.TrimSpace(string(body)))
+	} else {
+		err = json.Unmarshal(body, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the userinfo response: %w", err)
+	}
+	u := &UserInfo{Claims: claims}
+	u.Subject, _ = claims["sub"].(string)
+	u.Email, _ = claims["email"].(string)
+	u.EmailVerified, _ = claims["email_verified"].(bool)
+	u.Name, _ = claims["name"].(string)
+	if u.Subject == "" {
+		return nil, errors.New("Userinfo response does not contain sub")
+	}
+	if o.Subject != "" && u.Subject != o.Subject {
+		return nil, fmt.Errorf("Subject of the userinfo response wants %s but %s", o.Subject, u.Subject)
+	}
+	return u, nil
+}
@@ -0,0 +1,85 @@
+package oauth2cli_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/int128/oauth2cli"
+	"golang.org/x/oauth2"
+)
+
+func TestFetchUserInfo(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer ACCESS_TOKEN" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		switch r.URL.Path {
+		case "/userinfo":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"sub":"USER","email":"user@example.com","email_verified":true,"name":"User","locale":"en"}`)
+		case "/userinfo.jwt":
+			payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"USER"}`))
+			w.Header().Set("Content-Type", "application/jwt")
+			fmt.Fprint(w, "eyJhbGciOiJub25lIn0."+payload+".SIGNATURE")
+		default:
+			http.Error(w, "Not Found", 404)
+		}
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	token := &oauth2.Token{AccessToken: "ACCESS_TOKEN", TokenType: "Bearer"}
+
+	u, err := oauth2cli.FetchUserInfo(ctx, s.URL+"/userinfo", token)
+	if err != nil {
+		t.Fatalf("Could not fetch the userinfo: %s", err)
+	}
+	if u.Subject != "USER" || u.Email != "user@example.com" || !u.EmailVerified || u.Name != "User" {
+		t.Errorf("userinfo wants USER, user@example.com, true and User but %+v", u)
+	}
+	if u.Claims["locale"] != "en" {
+		t.Errorf("Claims wants locale=en but %v", u.Claims)
+	}
+
+	u, err = oauth2cli.FetchUserInfo(ctx, s.URL+"/userinfo.jwt", token)
+	if err != nil {
+		t.Fatalf("Could not fetch the userinfo: %s", err)
+	}
+	if u.Subject != "USER" {
+		t.Errorf("Subject wants USER but %s", u.Subject)
+	}
+
+	if _, err := oauth2cli.FetchUserInfo(ctx, s.URL+"/userinfo", &oauth2.Token{AccessToken: "INVALID"}); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}
+
+func TestFetchUserInfoWithOptions(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"sub":"USER"}`)
+	}))
+	defer s.Close()
+	ctx := context.Background()
+	token := &oauth2.Token{AccessToken: "ACCESS_TOKEN", TokenType: "Bearer"}
+
+	transport := &countTransport{}
+	o := oauth2cli.UserInfoOptions{Subject: "USER", HTTPClient: &http.Client{Transport: transport}}
+	if _, err := oauth2cli.FetchUserInfoWithOptions(ctx, s.URL, token, o); err != nil {
+		t.Fatalf("Could not fetch the userinfo: %s", err)
+	}
+	if transport.Count() != 1 {
+		t.Errorf("requests via HTTPClient wants 1 but %d", transport.Count())
+	}
+
+	// e.g. the access token is substituted with one of another user
+	o = oauth2cli.UserInfoOptions{Subject: "ANOTHER_USER"}
+	if _, err := oauth2cli.FetchUserInfoWithOptions(ctx, s.URL, token, o); err == nil {
+		t.Errorf("err wants non-nil but nil")
+	}
+}